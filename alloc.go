@@ -0,0 +1,399 @@
+package vfs
+
+import (
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+// The free bitmap is persisted in freeBucket as pages of bitmapPage bytes
+// keyed by their number, so a transaction only rewrites the pages it touches.
+// Trailing zeros of a page are not stored and empty pages are deleted.
+const bitmapPage = 4096
+
+// chunkBlocks is the number of blocks summarized by one free count of the
+// allocator, it must be a multiple of 8.
+const chunkBlocks = 512
+
+// bitmapPages applies changes to the persisted free bitmap.
+type bitmapPages struct {
+	bk    *bbolt.Bucket
+	pages map[uint32]FreeBitmap
+}
+
+func (m *bitmapPages) page(v uint32) (FreeBitmap, uint32) {
+	n := v / (bitmapPage * 8)
+	pg, ok := m.pages[n]
+	if !ok {
+		pg = make(FreeBitmap, bitmapPage)
+		copy(pg, m.bk.Get(uint32ToBytes(n)))
+		if m.pages == nil {
+			m.pages = map[uint32]FreeBitmap{}
+		}
+		m.pages[n] = pg
+	}
+	return pg, v % (bitmapPage * 8)
+}
+
+func (m *bitmapPages) Set(v uint32) {
+	pg, i := m.page(v)
+	pg.Set(i)
+}
+
+func (m *bitmapPages) Free(v uint32) {
+	pg, i := m.page(v)
+	pg.Free(i)
+}
+
+func (m *bitmapPages) flush() error {
+	for n, pg := range m.pages {
+		if err := putBitmapPage(m.bk, n, pg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putBitmapPage(bk *bbolt.Bucket, n uint32, pg FreeBitmap) error {
+	last := (pg.Last() + 7) / 8
+	if last == 0 {
+		return bk.Delete(uint32ToBytes(n))
+	}
+	return bk.Put(uint32ToBytes(n), append([]byte{}, pg[:last]...))
+}
+
+// loadBitmap returns the whole persisted free bitmap.
+func loadBitmap(tx *bbolt.Tx) (m FreeBitmap) {
+	tx.Bucket(freeBucket).ForEach(func(k, v []byte) error {
+		off := int(bytesToUint32(k)) * bitmapPage
+		m = append(m, make([]byte, off-len(m))...)
+		m = append(m, v...)
+		return nil
+	})
+	return m
+}
+
+// migrateBitmap moves the free bitmap of older packages, which is a single
+// value under freeKey, into pages.
+func migrateBitmap(tx *bbolt.Tx) error {
+	trunk := tx.Bucket(trunkBucket)
+	old := FreeBitmap(append([]byte{}, trunk.Get(freeKey)...))
+	if len(old) == 0 {
+		return trunk.Delete(freeKey)
+	}
+	bk := tx.Bucket(freeBucket)
+	for n := 0; n*bitmapPage < len(old); n++ {
+		end := (n + 1) * bitmapPage
+		if end > len(old) {
+			end = len(old)
+		}
+		if err := putBitmapPage(bk, uint32(n), old[n*bitmapPage:end]); err != nil {
+			return err
+		}
+	}
+	return trunk.Delete(freeKey)
+}
+
+// updateFreeBitmap marks space in use as allocated and space in free as
+// released in the persisted bitmap and slot masks of shared blocks.
+func updateFreeBitmap(tx *bbolt.Tx, slotSize int64, use, free space) error {
+	if use.empty() && free.empty() {
+		return nil
+	}
+	m := &bitmapPages{bk: tx.Bucket(freeBucket)}
+	use.blocks.ForEach(func(v uint32) error {
+		m.Set(v)
+		return nil
+	})
+	free.blocks.ForEach(func(v uint32) error {
+		m.Free(v)
+		return nil
+	})
+	if err := updateSlots(tx, slotSize, m, use.extents, free.extents); err != nil {
+		return err
+	}
+	return m.flush()
+}
+
+// allocator hands out blocks to concurrent writers. Its bitmap holds both
+// committed blocks and blocks reserved by uploads still in progress, while the
+// persisted bitmap only ever sees committed ones, so blocks of an upload that
+// never commits are free again after reopening.
+//
+// Writers reserve blocks through claims: a claim is a run of free blocks big
+// enough for the expected size of the write, other writers keep away from it
+// so files are stored contiguously as long as the free space allows.
+type allocator struct {
+	mu        sync.Mutex
+	used      FreeBitmap
+	chunkFree []uint16 // free blocks of every chunk of used
+	end       uint32   // blocks covered by the store
+	claims    map[*claim]bool
+	pins      int   // readers which need freed blocks to stay intact
+	pending   space // space freed while pinned
+	punch     func(b, n uint32) error
+	slots     // slots of shared blocks
+}
+
+// claim is the run of blocks a writer is filling, from next up to end.
+type claim struct {
+	next, end uint32
+	size      int64  // blocks still expected, 0 if unknown
+	grow      uint32 // length of the next run if size is unknown
+	fill      bool   // take the first free blocks, regardless of contiguity
+}
+
+// want returns the length of the run to claim next.
+func (c *claim) want() uint32 {
+	switch {
+	case c.fill:
+		return 1
+	case c.size > 0:
+		if c.size > 1<<20 {
+			return 1 << 20
+		}
+		return uint32(c.size)
+	}
+	if c.grow < 16 {
+		c.grow = 16
+	} else if c.grow < 1024 {
+		c.grow *= 2
+	}
+	return c.grow
+}
+
+// newClaim returns a claim for writing size bytes, or an unknown amount if
+// size is negative.
+func (p *Package) newClaim(size int64) *claim {
+	if size < 0 {
+		return &claim{}
+	}
+	n := size / p.blockSize
+	if rem := size % p.blockSize; rem > 0 && !p.packable(int(rem)) {
+		n++
+	}
+	return &claim{size: n}
+}
+
+// load replaces the bitmap of the allocator.
+func (a *allocator) load(m FreeBitmap) {
+	a.used, a.chunkFree = nil, nil
+	for i, v := range m {
+		for j := uint32(0); j < 8; j++ {
+			if v&(1<<j) != 0 {
+				a.set(uint32(i)*8 + j)
+			}
+		}
+	}
+}
+
+func (a *allocator) isUsed(v uint32) bool {
+	return int(v/8) < len(a.used) && a.used[v/8]&(1<<(v%8)) != 0
+}
+
+func (a *allocator) set(v uint32) {
+	for int(v/8) >= len(a.used) {
+		a.used = append(a.used, make([]byte, chunkBlocks/8)...)
+		a.chunkFree = append(a.chunkFree, chunkBlocks)
+	}
+	if !a.isUsed(v) {
+		a.used.Set(v)
+		a.chunkFree[v/chunkBlocks]--
+	}
+}
+
+func (a *allocator) unset(v uint32) {
+	if a.isUsed(v) {
+		a.used.Free(v)
+		a.chunkFree[v/chunkBlocks]++
+	}
+}
+
+// claimed returns a claim of another writer covering block v.
+func (a *allocator) claimed(self *claim, v uint32) *claim {
+	for c := range a.claims {
+		if c != self && c.next <= v && v < c.end {
+			return c
+		}
+	}
+	return nil
+}
+
+// overlaps tells whether another claim overlaps blocks from v to end.
+func (a *allocator) overlaps(self *claim, v, end uint32) bool {
+	for c := range a.claims {
+		if c != self && c.next < end && v < c.end {
+			return true
+		}
+	}
+	return false
+}
+
+// findFree returns the first run of n free and unclaimed blocks from block
+// from. Runs reaching the end of the bitmap are long enough.
+func (a *allocator) findFree(self *claim, from, n uint32) uint32 {
+	total := uint32(len(a.used)) * 8
+	start, run, v := from, uint32(0), from
+	for v < total && run < n {
+		if v%chunkBlocks == 0 {
+			switch free := a.chunkFree[v/chunkBlocks]; {
+			case free == 0:
+				v, run = v+chunkBlocks, 0
+				continue
+			case free == chunkBlocks && !a.overlaps(self, v, v+chunkBlocks):
+				if run == 0 {
+					start = v
+				}
+				v, run = v+chunkBlocks, run+chunkBlocks
+				continue
+			}
+		}
+		if c := a.claimed(self, v); c != nil {
+			v, run = c.end, 0
+			continue
+		}
+		if a.isUsed(v) {
+			v, run = v+1, 0
+			continue
+		}
+		if run == 0 {
+			start = v
+		}
+		v, run = v+1, run+1
+	}
+	if run == 0 {
+		start = v
+	}
+	// A run reaching the end of the bitmap goes on, keep it clear of claims there
+	for v = start + run; v < start+n; v++ {
+		if c := a.claimed(self, v); c != nil {
+			start, run, v = c.end, 0, c.end-1
+		}
+	}
+	return start
+}
+
+// reserve reserves the next block of claim c, it tells whether the block is
+// beyond the end of the store.
+func (a *allocator) reserve(c *claim) (uint32, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c.next >= c.end || a.isUsed(c.next) || a.claimed(c, c.next) != nil {
+		n := c.want()
+		from := uint32(0)
+		if c.fill {
+			from = c.next
+		}
+		c.next = a.findFree(c, from, n)
+		c.end = c.next + n
+		if a.claims == nil {
+			a.claims = map[*claim]bool{}
+		}
+		a.claims[c] = true
+	}
+	v := c.next
+	c.next++
+	if c.size > 0 {
+		c.size--
+	}
+	return v, a.take(v)
+}
+
+// take marks block v as used and tells whether it is beyond the end of the
+// store.
+func (a *allocator) take(v uint32) bool {
+	a.set(v)
+	if v < a.end {
+		return false
+	}
+	a.end = v + 1
+	return true
+}
+
+func (a *allocator) unclaim(c *claim) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.claims, c)
+}
+
+// free returns space of committed changes to the allocator, it is held back
+// until no reader has the allocator pinned.
+func (a *allocator) free(s space) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pins > 0 {
+		a.pending.merge(s)
+		return
+	}
+	a.clear(s)
+}
+
+func (a *allocator) pin() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pins++
+}
+
+func (a *allocator) unpin() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pins--; a.pins == 0 {
+		a.clear(a.pending)
+		a.pending = space{}
+	}
+}
+
+// clear frees space s, punching holes for the freed blocks if enabled.
+// Failing to punch is harmless, so errors are ignored.
+func (a *allocator) clear(s space) {
+	s.blocks.ForEachRun(func(start, n uint32) error {
+		for v := start; v < start+n; v++ {
+			a.unset(v)
+		}
+		if a.punch != nil {
+			a.punch(start, n)
+		}
+		return nil
+	})
+	for _, e := range s.extents {
+		if a.setMask(e.Block, a.masks[e.Block]&^e.mask(a.slotSize)) == 0 {
+			a.unset(e.Block)
+			if a.punch != nil {
+				a.punch(e.Block, 1)
+			}
+		}
+	}
+}
+
+// sweep calls punch with every run of free blocks before the last used one.
+func (a *allocator) sweep(punch func(b, n uint32) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	start, last := uint32(0), uint32(a.used.Last())
+	for v := uint32(0); v <= last; v++ {
+		if v < last && !a.isUsed(v) {
+			continue
+		}
+		if v > start {
+			if err := punch(start, v-start); err != nil {
+				return err
+			}
+		}
+		start = v + 1
+	}
+	return nil
+}
+
+// release returns reserved space which has never been committed. trim, if not nil, is called with
+// the number of blocks still in use while no new block can be reserved, so the
+// data file can be safely cut after its last used block.
+func (a *allocator) release(s space, trim func(int64)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clear(s)
+	if trim != nil {
+		last := a.used.Last()
+		trim(last)
+		a.end = uint32(last)
+	}
+}
@@ -0,0 +1,238 @@
+package vfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// paxTagPrefix prefixes PAX records holding tags.
+	paxTagPrefix = "VFS.tag."
+	// zipTagsExtraID is the header ID of the zip extra field holding tags as JSON.
+	zipTagsExtraID = 0x5646
+)
+
+// exportEach calls f for every file and empty directory under prefix. All
+// calls happen in one snapshot, so the export is point-in-time.
+func (p *Package) exportEach(prefix string, f func(rel string, m Meta) error) error {
+	prefix = path.Join("/", prefix)
+	if prefix != "/" {
+		prefix += "/"
+	}
+	return p.snapshot(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(trunkBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			m, err := unmarshalMeta(v, p.blockSize)
+			if err != nil {
+				return fmt.Errorf("export %q: %w", k, err)
+			}
+			if rel := m.Name[len(prefix):]; rel != "" {
+				if err := f(rel, m); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (p *Package) exportData(w io.Writer, m Meta) error {
+	r, err := p.openMeta(m)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// archiveKey maps an archive entry name into prefix, only directories may
+// map to prefix itself, like "./".
+func archiveKey(prefix, name string, dir bool) (string, error) {
+	prefix = path.Join("/", prefix)
+	key := path.Join(prefix, name)
+	if key == prefix && !dir || key != prefix && prefix != "/" && !strings.HasPrefix(key, prefix+"/") {
+		return "", fmt.Errorf("archive entry %q: outside of %q", name, prefix)
+	}
+	return key, nil
+}
+
+func tagsToKVs(tags map[string]string) []string {
+	kvs := make([]string, 0, len(tags)*2)
+	for k, v := range tags {
+		kvs = append(kvs, k, v)
+	}
+	return kvs
+}
+
+// ExportTar writes files under prefix as a PAX tar stream, tags are stored
+// in "VFS.tag.<key>" records.
+func (p *Package) ExportTar(w io.Writer, prefix string) error {
+	tw := tar.NewWriter(w)
+	if err := p.exportEach(prefix, func(rel string, m Meta) error {
+		hdr := &tar.Header{
+			Name:     rel,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     m.Size,
+			ModTime:  time.Unix(m.ModTime, 0),
+			Format:   tar.FormatPAX,
+		}
+		if m.IsDir {
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0755, 0
+		}
+		for k, v := range m.Tags {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxTagPrefix+k] = v
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if m.IsDir {
+			return nil
+		}
+		return p.exportData(tw, m)
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ImportTar writes regular files and directories of a tar stream into prefix,
+// other entries like links and devices fail the import.
+func (p *Package) ImportTar(r io.Reader, prefix string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key, err := archiveKey(prefix, hdr.Name, hdr.Typeflag == tar.TypeDir)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if key != path.Join("/", prefix) {
+				err = p.Mkdir(key)
+			}
+		// TypeRegA is deprecated, older archivers still write it for regular
+		// files and readers of older Go versions return it as is
+		case tar.TypeReg, tar.TypeRegA:
+			var kvs []string
+			for k, v := range hdr.PAXRecords {
+				if strings.HasPrefix(k, paxTagPrefix) {
+					kvs = append(kvs, k[len(paxTagPrefix):], v)
+				}
+			}
+			err = p.writeWithModTime(context.Background(), key, tr, hdr.ModTime.Unix(), kvs)
+		case tar.TypeXGlobalHeader:
+			// Records of the whole archive, there is nothing to import
+		default:
+			err = fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("import %s: %v", hdr.Name, err)
+		}
+	}
+}
+
+// ExportZip writes files under prefix as a zip archive, tags are stored as
+// JSON in an extra field.
+func (p *Package) ExportZip(w io.Writer, prefix string) error {
+	zw := zip.NewWriter(w)
+	if err := p.exportEach(prefix, func(rel string, m Meta) error {
+		hdr := &zip.FileHeader{
+			Name:     rel,
+			Method:   zip.Deflate,
+			Modified: time.Unix(m.ModTime, 0),
+		}
+		if m.IsDir {
+			hdr.Method = zip.Store
+		}
+		if len(m.Tags) > 0 {
+			buf, _ := json.Marshal(m.Tags)
+			if len(buf) > 0xffff {
+				return fmt.Errorf("export %s: tags too large", m.Name)
+			}
+			hdr.Extra = make([]byte, 4, 4+len(buf))
+			binary.LittleEndian.PutUint16(hdr.Extra, zipTagsExtraID)
+			binary.LittleEndian.PutUint16(hdr.Extra[2:], uint16(len(buf)))
+			hdr.Extra = append(hdr.Extra, buf...)
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if m.IsDir {
+			return nil
+		}
+		return p.exportData(fw, m)
+	}); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ImportZip writes files and directories of a zip archive into prefix.
+func (p *Package) ImportZip(r io.ReaderAt, size int64, prefix string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		key, err := archiveKey(prefix, f.Name, strings.HasSuffix(f.Name, "/"))
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(f.Name, "/") {
+			if key != path.Join("/", prefix) {
+				err = p.Mkdir(key)
+			}
+		} else {
+			err = p.importZipFile(key, f)
+		}
+		if err != nil {
+			return fmt.Errorf("import %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *Package) importZipFile(key string, f *zip.File) error {
+	var tags map[string]string
+	for extra := f.Extra; len(extra) >= 4; {
+		id, n := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+n {
+			break
+		}
+		if id == zipTagsExtraID {
+			if err := json.Unmarshal(extra[4:4+n], &tags); err != nil {
+				return err
+			}
+		}
+		extra = extra[4+n:]
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return p.writeWithModTime(context.Background(), key, rc, f.Modified.Unix(), tagsToKVs(tags))
+}
@@ -0,0 +1,94 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"go.etcd.io/bbolt"
+)
+
+// Batch collects operations to be committed atomically by Package.Batch.
+// Data of Write is uploaded immediately, other operations are validated and
+// applied in order when the batch commits.
+type Batch struct {
+	p        *Package
+	reserved space
+	ops      []func(tx *bbolt.Tx, st *txState) error
+}
+
+// Batch calls f to collect operations and commits all of them in a single
+// transaction. If f or any operation fails, nothing is committed and blocks
+// uploaded by the batch are released.
+func (p *Package) Batch(f func(b *Batch) error) error {
+	b := &Batch{p: p}
+	if err := f(b); err != nil {
+		p.alloc.release(b.reserved, p.trimData)
+		return err
+	}
+	return p.update(b.reserved, func(tx *bbolt.Tx, st *txState) error {
+		for _, op := range b.ops {
+			if err := op(tx, st); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Batch) WriteAll(key string, value []byte, kvs ...string) error {
+	return b.Write(key, bytes.NewReader(value), kvs...)
+}
+
+func (b *Batch) Write(key string, value io.Reader, kvs ...string) error {
+	return b.WriteContext(context.Background(), key, value, kvs...)
+}
+
+func (b *Batch) WriteContext(ctx context.Context, key string, value io.Reader, kvs ...string) error {
+	op, reserved, err := b.p.prepareWrite(ctx, key, value, kvs)
+	if err != nil {
+		b.add(err, nil)
+		return err
+	}
+	b.reserved.merge(reserved)
+	b.add(nil, func(tx *bbolt.Tx, st *txState) error {
+		return b.p.writeTx(tx, st, op, nil)
+	})
+	return nil
+}
+
+func (b *Batch) Delete(key string) {
+	op, err := b.p.newOp(OpDelete, key, "")
+	b.add(err, func(tx *bbolt.Tx, st *txState) error {
+		return b.p.deleteTx(tx, st, op, nil)
+	})
+}
+
+func (b *Batch) Move(oldname, newname string, overwrite bool) {
+	op, err := b.p.newOp(OpMove, newname, oldname)
+	b.add(err, func(tx *bbolt.Tx, st *txState) error {
+		return b.p.moveTx(tx, st, op, overwrite, nil)
+	})
+}
+
+func (b *Batch) UpdateTags(key string, f func(map[string]string) error) {
+	op, err := b.p.newOp(OpUpdateTags, key, "")
+	b.add(err, func(tx *bbolt.Tx, st *txState) error {
+		return b.p.updateTagsTx(tx, st, op, f, nil)
+	})
+}
+
+func (b *Batch) Mkdir(key string) {
+	op, err := b.p.newOp(OpMkdir, key, "")
+	b.add(err, func(tx *bbolt.Tx, st *txState) error {
+		return b.p.mkdirTx(tx, st, op)
+	})
+}
+
+// add queues f, or err to fail the batch if a hook has rejected the operation.
+func (b *Batch) add(err error, f func(tx *bbolt.Tx, st *txState) error) {
+	if err != nil {
+		f = func(*bbolt.Tx, *txState) error { return err }
+	}
+	b.ops = append(b.ops, f)
+}
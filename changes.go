@@ -0,0 +1,167 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+type Op string
+
+const (
+	OpWrite      Op = "write"
+	OpAppend     Op = "append"
+	OpDelete     Op = "delete"
+	OpMove       Op = "move"
+	OpUpdateTags Op = "tags"
+	OpMkdir      Op = "mkdir"
+	OpOpen       Op = "open" // seen by hooks only
+)
+
+// Event is an entry of the change log, it is written in the same transaction
+// as the change itself.
+type Event struct {
+	Seq        uint64 `json:"-"`
+	Op         Op     `json:"op"`
+	Name       string `json:"n"`
+	OldName    string `json:"o,omitempty"` // source of OpMove
+	Size       int64  `json:"sz,omitempty"`
+	Crc32      uint32 `json:"crc,omitempty"`
+	Generation int64  `json:"g,omitempty"`
+	Time       int64  `json:"t"`
+}
+
+func logChange(tx *bbolt.Tx, op Op, oldName string, m Meta) error {
+	bk := tx.Bucket(changesBucket)
+	seq, err := bk.NextSequence()
+	if err != nil {
+		return err
+	}
+	buf, _ := json.Marshal(Event{
+		Op:         op,
+		Name:       m.Name,
+		OldName:    oldName,
+		Size:       m.Size,
+		Crc32:      m.Crc32,
+		Generation: m.Generation,
+		Time:       time.Now().Unix(),
+	})
+	return bk.Put(int64ToBytes(int64(seq)), buf)
+}
+
+func (e Event) match(prefix string) bool {
+	return strings.HasPrefix(e.Name, prefix) || (e.OldName != "" && strings.HasPrefix(e.OldName, prefix))
+}
+
+// Changes calls f for every logged change under prefix with a sequence not
+// less than fromSeq. f is called outside of any transaction.
+func (p *Package) Changes(prefix string, fromSeq uint64, f func(Event) error) error {
+	for more := true; more; {
+		var events []Event
+		more = false
+		// Read in small batches so the transaction is not held while calling f
+		if err := p.db.View(func(tx *bbolt.Tx) error {
+			c := tx.Bucket(changesBucket).Cursor()
+			n := 0
+			for k, v := c.Seek(int64ToBytes(int64(fromSeq))); len(k) > 0; k, v = c.Next() {
+				if n++; n > 256 {
+					more = true
+					break
+				}
+				e := Event{}
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+				e.Seq = uint64(bytesToInt64(k))
+				fromSeq = e.Seq + 1
+				if e.match(prefix) {
+					events = append(events, e)
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := f(e); err != nil {
+				if err == ErrAbort {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Watch streams changes under prefix starting from fromSeq, waiting for new
+// ones once the log is drained. A consumer can resume after restart by passing
+// the last sequence it has seen plus one. The channel is closed when ctx is
+// done or the package is closed.
+func (p *Package) Watch(ctx context.Context, prefix string, fromSeq uint64) <-chan Event {
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		for {
+			wait := p.notify.wait()
+			if err := p.Changes(prefix, fromSeq, func(e Event) error {
+				select {
+				case ch <- e:
+					fromSeq = e.Seq + 1
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}); err != nil {
+				return
+			}
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// TrimChanges removes logged changes with a sequence less than seq.
+func (p *Package) TrimChanges(seq uint64) error {
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(changesBucket).Cursor()
+		for k, _ := c.First(); len(k) > 0 && uint64(bytesToInt64(k)) < seq; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// notifier wakes up all waiters whenever something is committed.
+type notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *notifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
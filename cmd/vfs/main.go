@@ -0,0 +1,501 @@
+// Command vfs inspects and manages packages.
+//
+//	vfs [-json] <package> <command> [arguments]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/vfs"
+)
+
+const usage = `usage: vfs [-json] [-segment bytes] [-punch] [-durability mode] <package> <command> [arguments]
+
+commands:
+  ls [dir]                    list a directory
+  tree [dir]                  list a directory recursively
+  cat <key>                   write a file to stdout
+  put [-t k=v]... <src> <key> store a local file, "-" reads stdin
+  get <key> [dst]             save a file locally
+  rm <key>...                 delete files or empty directories
+  mv [-f] <old> <new>         rename a file
+  cp [-f] <src> <dst>         copy a file
+  stat                        show package statistics
+  info <key>                  show a file or directory
+  tags get <key>              show tags of a file
+  tags set <key> <k=v>...     update tags of a file, "k=" removes k
+  search [-n max] <dir> <s>   find names containing s
+  du [dir]                    summarize sizes of subdirectories
+  verify [dir]                check CRC32 of all files
+  compact                     move data into holes and shrink the data file
+  reclaim                     release disk space of free blocks
+  frag [dir]                  show fragmented files and free holes
+  defrag <key>...             store files in contiguous blocks
+  dropseg <n>                 remove segment file n, which must hold no data
+  migrate                     rewrite metas of older versions in the current encoding
+`
+
+var (
+	jsonOutput  = flag.Bool("json", false, "print results as JSON")
+	segmentSize = flag.Int64("segment", 0, "split data of a new package into files of this size")
+	punchHoles  = flag.Bool("punch", false, "release disk space of blocks as they are freed")
+	durability  = flag.String("durability", "strict", "sync data before commits: strict, batched or none")
+)
+
+// stdout receives results, tests replace it.
+var stdout io.Writer = os.Stdout
+
+// creates lists the commands which may create the package.
+var creates = map[string]bool{"put": true}
+
+type entry struct {
+	Name       string            `json:"name"`
+	IsDir      bool              `json:"dir,omitempty"`
+	Size       int64             `json:"size"`
+	Count      int64             `json:"count,omitempty"`
+	Crc32      uint32            `json:"crc32,omitempty"`
+	Generation int64             `json:"generation,omitempty"`
+	CreateTime int64             `json:"ctime,omitempty"`
+	ModTime    int64             `json:"mtime,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+func toEntry(m vfs.Meta) entry {
+	return entry{
+		Name:       m.Name,
+		IsDir:      m.IsDir,
+		Size:       m.Size,
+		Count:      m.Count,
+		Crc32:      m.Crc32,
+		Generation: m.Generation,
+		CreateTime: m.CreateTime,
+		ModTime:    m.ModTime,
+		Tags:       m.Tags,
+	}
+}
+
+func (e entry) String() string {
+	if e.IsDir {
+		return fmt.Sprintf("%12s  %-16s  %s", "-", "", e.Name)
+	}
+	return fmt.Sprintf("%12d  %s  %s", e.Size, time.Unix(e.ModTime, 0).Format("2006-01-02 15:04"), e.Name)
+}
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	o := vfs.OpenOptions{SegmentSize: *segmentSize, PunchHoles: *punchHoles}
+	for d := vfs.DurabilityStrict; d <= vfs.DurabilityNone; d++ {
+		if d.String() == *durability {
+			o.Durability = d
+		}
+	}
+	if o.Durability.String() != *durability {
+		fatal(fmt.Errorf("unknown durability %q", *durability))
+	}
+	if err := openAndRun(flag.Arg(0), o, flag.Arg(1), flag.Args()[2:]); err != nil {
+		fatal(err)
+	}
+}
+
+// openAndRun runs cmd on the package at path, only commands in creates may
+// run on a package which does not exist yet.
+func openAndRun(path string, o vfs.OpenOptions, cmd string, args []string) error {
+	index := strings.TrimSuffix(path, ".index") + ".index"
+	if _, err := os.Stat(index); os.IsNotExist(err) && !creates[cmd] {
+		return fmt.Errorf("%s: no such package", index)
+	}
+	p, err := vfs.Open(path, o)
+	if err != nil {
+		return err
+	}
+	err = run(p, cmd, args)
+	if err2 := p.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "vfs:", err)
+	os.Exit(1)
+}
+
+// output prints v as JSON, or calls human to print it otherwise.
+func output(v interface{}, human func()) {
+	if *jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	human()
+}
+
+func arg(args []string, i int, def string) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return def
+}
+
+func need(args []string, n int) error {
+	if len(args) < n {
+		return fmt.Errorf("missing arguments, see vfs -h")
+	}
+	return nil
+}
+
+func run(p *vfs.Package, cmd string, args []string) error {
+	ctx := context.Background()
+	switch cmd {
+	case "ls":
+		metas, err := p.List(arg(args, 0, "/"))
+		if err != nil {
+			return err
+		}
+		entries := make([]entry, len(metas))
+		for i, m := range metas {
+			entries[i] = toEntry(m)
+		}
+		output(entries, func() {
+			for _, e := range entries {
+				fmt.Fprintln(stdout, e)
+			}
+		})
+	case "tree":
+		var entries []entry
+		var lines []string
+		var walk func(dir string, depth int) error
+		walk = func(dir string, depth int) error {
+			metas, err := p.List(dir)
+			if err != nil {
+				return err
+			}
+			for _, m := range metas {
+				entries = append(entries, toEntry(m))
+				name := filepath.Base(m.Name)
+				if m.IsDir {
+					name += "/"
+				}
+				lines = append(lines, strings.Repeat("  ", depth)+name)
+				if m.IsDir {
+					if err := walk(m.Name, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if err := walk(arg(args, 0, "/"), 0); err != nil {
+			return err
+		}
+		output(entries, func() {
+			for _, l := range lines {
+				fmt.Fprintln(stdout, l)
+			}
+		})
+	case "cat":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		r, err := p.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(stdout, r)
+		return err
+	case "put":
+		fs := flag.NewFlagSet("put", flag.ExitOnError)
+		var tags kvFlag
+		fs.Var(&tags, "t", "tag `k=v`, can be repeated")
+		fs.Parse(args)
+		if err := need(fs.Args(), 2); err != nil {
+			return err
+		}
+		src := io.Reader(os.Stdin)
+		if name := fs.Arg(0); name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			src = f
+		}
+		return p.WriteContext(ctx, fs.Arg(1), src, tags...)
+	case "get":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		r, err := p.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		f, err := os.Create(arg(args, 1, filepath.Base(args[0])))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case "rm":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		for _, key := range args {
+			if err := p.Delete(key); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	case "mv", "cp":
+		fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+		force := fs.Bool("f", false, "overwrite the destination")
+		fs.Parse(args)
+		if err := need(fs.Args(), 2); err != nil {
+			return err
+		}
+		if cmd == "mv" {
+			return p.Move(fs.Arg(0), fs.Arg(1), *force)
+		}
+		return p.Copy(fs.Arg(0), fs.Arg(1), *force)
+	case "stat":
+		s := p.Stat()
+		output(s, func() {
+			fmt.Fprintln(stdout, "files:       ", s.Files)
+			fmt.Fprintln(stdout, "size:        ", s.Size)
+			fmt.Fprintln(stdout, "disk size:   ", s.DiskSize)
+			fmt.Fprintln(stdout, "data size:   ", s.DataSize)
+			fmt.Fprintln(stdout, "data alloc:  ", s.DataAlloc)
+			fmt.Fprintln(stdout, "alloc blocks:", s.AllocBlocks)
+			fmt.Fprintln(stdout, "index file:  ", s.IndexFile)
+			fmt.Fprintln(stdout, "data file:   ", s.DataFile)
+		})
+	case "info":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		m, err := p.Info(args[0])
+		if err != nil {
+			return err
+		}
+		output(toEntry(m), func() { fmt.Fprintln(stdout, m) })
+	case "tags":
+		if err := need(args, 2); err != nil {
+			return err
+		}
+		switch args[0] {
+		case "get":
+			m, err := p.Info(args[1])
+			if err != nil {
+				return err
+			}
+			output(m.Tags, func() {
+				keys := make([]string, 0, len(m.Tags))
+				for k := range m.Tags {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					fmt.Fprintf(stdout, "%s=%s\n", k, m.Tags[k])
+				}
+			})
+		case "set":
+			var kvs kvFlag
+			for _, kv := range args[2:] {
+				if err := kvs.Set(kv); err != nil {
+					return err
+				}
+			}
+			return p.UpdateTags(args[1], func(tags map[string]string) error {
+				for i := 0; i < len(kvs); i += 2 {
+					if kvs[i+1] == "" {
+						delete(tags, kvs[i])
+					} else {
+						tags[kvs[i]] = kvs[i+1]
+					}
+				}
+				return nil
+			})
+		default:
+			return fmt.Errorf("unknown tags command %q", args[0])
+		}
+	case "search":
+		fs := flag.NewFlagSet("search", flag.ExitOnError)
+		max := fs.Int("n", 100, "max results")
+		fs.Parse(args)
+		if err := need(fs.Args(), 2); err != nil {
+			return err
+		}
+		metas, err := p.SearchContext(ctx, fs.Arg(0), fs.Arg(1), *max)
+		if err != nil {
+			return err
+		}
+		entries := make([]entry, len(metas))
+		for i, m := range metas {
+			entries[i] = toEntry(m)
+		}
+		output(entries, func() {
+			for _, e := range entries {
+				fmt.Fprintln(stdout, e)
+			}
+		})
+	case "du":
+		dir := strings.TrimSuffix(arg(args, 0, "/"), "/") + "/"
+		sums := map[string]*entry{}
+		total := entry{Name: dir, IsDir: true}
+		if err := p.ForEachMetaContext(ctx, dir, func(m vfs.Meta) error {
+			name := m.Name
+			if idx := strings.Index(m.Name[len(dir):], "/"); idx > -1 {
+				name = m.Name[:len(dir)+idx+1]
+			}
+			e := sums[name]
+			if e == nil {
+				e = &entry{Name: name, IsDir: strings.HasSuffix(name, "/")}
+				sums[name] = e
+			}
+			e.Size += m.Size
+			e.Count++
+			total.Size += m.Size
+			total.Count++
+			return nil
+		}); err != nil {
+			return err
+		}
+		entries := make([]entry, 0, len(sums)+1)
+		for _, e := range sums {
+			entries = append(entries, *e)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		entries = append(entries, total)
+		output(entries, func() {
+			for _, e := range entries {
+				fmt.Fprintf(stdout, "%12d  %8d  %s\n", e.Size, e.Count, e.Name)
+			}
+		})
+	case "verify":
+		type result struct {
+			Name  string `json:"name"`
+			Error string `json:"error"`
+		}
+		var bad []result
+		if err := p.ForEachContext(ctx, arg(args, 0, "/"), func(m vfs.Meta, r io.Reader) error {
+			h := crc32.NewIEEE()
+			n, err := io.Copy(h, r)
+			switch {
+			case err != nil:
+				bad = append(bad, result{m.Name, err.Error()})
+			case n != m.Size:
+				bad = append(bad, result{m.Name, fmt.Sprintf("size mismatch: %d, expect %d", n, m.Size)})
+			case h.Sum32() != m.Crc32:
+				bad = append(bad, result{m.Name, fmt.Sprintf("crc32 mismatch: %08x, expect %08x", h.Sum32(), m.Crc32)})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		output(bad, func() {
+			for _, r := range bad {
+				fmt.Fprintf(stdout, "%s: %s\n", r.Name, r.Error)
+			}
+		})
+		if len(bad) > 0 {
+			return fmt.Errorf("%d corrupted files", len(bad))
+		}
+	case "compact":
+		before := p.Stat().DiskSize
+		if err := p.Compact(ctx); err != nil {
+			return err
+		}
+		after := p.Stat().DiskSize
+		output(map[string]int64{"before": before, "after": after}, func() {
+			fmt.Fprintf(stdout, "disk size: %d -> %d\n", before, after)
+		})
+	case "reclaim":
+		before := p.Stat().DataAlloc
+		if err := p.ReclaimFreeSpace(); err != nil {
+			return err
+		}
+		after := p.Stat().DataAlloc
+		output(map[string]int64{"before": before, "after": after}, func() {
+			fmt.Fprintf(stdout, "data alloc: %d -> %d\n", before, after)
+		})
+	case "frag":
+		r, err := p.Fragmentation(arg(args, 0, "/"))
+		if err != nil {
+			return err
+		}
+		output(r, func() {
+			for _, f := range r.Files {
+				if f.Extents > 1 {
+					fmt.Fprintf(stdout, "%8d  %6d  %s\n", f.Blocks, f.Extents, f.Name)
+				}
+			}
+			fmt.Fprintln(stdout, "used blocks:", r.UsedBlocks)
+			fmt.Fprintln(stdout, "free blocks:", r.FreeBlocks)
+			for i, n := range r.Holes {
+				if n > 0 {
+					fmt.Fprintf(stdout, "holes of %d+ blocks: %d\n", 1<<uint(i), n)
+				}
+			}
+		})
+	case "defrag":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		return p.Defragment(ctx, args)
+	case "dropseg":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		return p.DropSegment(n)
+	case "migrate":
+		n, err := p.MigrateMetas(ctx)
+		if err != nil {
+			return err
+		}
+		output(map[string]int{"migrated": n}, func() {
+			fmt.Fprintf(stdout, "migrated metas: %d\n", n)
+		})
+	default:
+		return fmt.Errorf("unknown command %q, see vfs -h", cmd)
+	}
+	return nil
+}
+
+// kvFlag collects k=v arguments as key value pairs.
+type kvFlag []string
+
+func (f *kvFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *kvFlag) Set(v string) error {
+	idx := strings.Index(v, "=")
+	if idx < 1 {
+		return fmt.Errorf("invalid tag %q, expect k=v", v)
+	}
+	*f = append(*f, v[:idx], v[idx+1:])
+	return nil
+}
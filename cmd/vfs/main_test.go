@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coyove/vfs"
+)
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pkg")
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		args []string
+		json bool
+		want string // substring of the output, or of the error if err is set
+		err  bool
+	}{
+		{args: []string{"ls"}, want: "no such package", err: true},
+		{args: []string{"tags", "get", "/a/b"}, want: "no such package", err: true},
+		{args: []string{"put", "-t", "k=v", src, "/a/b"}},
+		{args: []string{"put", src}, want: "missing arguments", err: true},
+		{args: []string{"ls", "/a"}, want: "5  "},
+		{args: []string{"ls", "/a"}, want: `"name": "/a/b"`, json: true},
+		{args: []string{"ls", "/"}, want: `"dir": true`, json: true},
+		{args: []string{"get", "/a/b", dst}},
+		{args: []string{"get", "/a/c", dst}, want: vfs.ErrNotFound.Error(), err: true},
+		{args: []string{"tags", "get", "/a/b"}, want: "k=v\n"},
+		{args: []string{"tags", "set", "/a/b", "k=", "x=1"}},
+		{args: []string{"tags", "get", "/a/b"}, want: "{\n  \"x\": \"1\"\n}\n", json: true},
+		{args: []string{"tags", "set", "/a/b", "bad"}, want: "invalid tag", err: true},
+		{args: []string{"info", "/a/b"}, want: `"size": 5`, json: true},
+		{args: []string{"verify"}, want: ""},
+		{args: []string{"verify"}, want: "null\n", json: true},
+		{args: []string{"nope"}, want: "unknown command", err: true},
+	} {
+		buf := &bytes.Buffer{}
+		stdout, *jsonOutput = buf, c.json
+		err := openAndRun(path, vfs.OpenOptions{}, c.args[0], c.args[1:])
+		got := buf.String()
+		if err != nil {
+			got = err.Error()
+		}
+		if (err != nil) != c.err || !strings.Contains(got, c.want) {
+			t.Fatalf("%v: got %q, %v", c.args, got, err)
+		}
+		if c.json && !c.err && !json.Valid(buf.Bytes()) {
+			t.Fatalf("%v: invalid JSON %q", c.args, got)
+		}
+	}
+	if buf, _ := ioutil.ReadFile(dst); string(buf) != "hello" {
+		t.Fatal(string(buf))
+	}
+}
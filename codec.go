@@ -0,0 +1,286 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+// Metas are encoded in binary, starting with metaVersion. Older packages
+// store them in JSON, which is still read and can be converted in place by
+// MigrateMetas.
+const metaVersion = 1
+
+// unmarshalMeta decodes a meta of a package of blockSize blocks and checks
+// its data can be read.
+func unmarshalMeta(p []byte, blockSize int64) (m Meta, err error) {
+	switch {
+	case len(p) > 0 && p[0] == metaVersion:
+		m, err = decodeMeta(p[1:])
+	case len(p) > 0 && p[0] == '{':
+		var v struct {
+			Meta
+			Legacy []byte `json:"pos"` // block list of older metas, rewritten as runs when saved again
+		}
+		if err = json.Unmarshal(p, &v); err != nil {
+			err = fmt.Errorf("%w: %v", ErrCorruptMeta, err)
+		}
+		if m = v.Meta; len(v.Legacy) > 0 {
+			m.Positions = legacyBlocks(v.Legacy)
+		}
+	default:
+		err = fmt.Errorf("%w: unknown encoding", ErrCorruptMeta)
+	}
+	if err == nil {
+		err = m.check(blockSize)
+	}
+	if err != nil {
+		return Meta{}, err
+	}
+	m.IsDir = strings.HasSuffix(m.Name, "/")
+	return m, nil
+}
+
+// check tells whether runs of blocks are well formed and data fits in them.
+func (m Meta) check(blockSize int64) error {
+	if len(m.SmallData) == int(m.Size) && len(m.Positions) == 0 && m.Tail == nil {
+		return nil
+	}
+	var blocks int64
+	if err := m.Positions.ForEachRun(func(_, n uint32) error {
+		blocks += int64(n)
+		return nil
+	}); err != nil {
+		return err
+	}
+	size := blocks * blockSize
+	if e := m.Tail; e != nil {
+		if e.Off < 0 || e.Len <= 0 || e.Off+e.Len > blockSize {
+			return fmt.Errorf("%w: tail %d+%d out of block", ErrCorruptMeta, e.Off, e.Len)
+		}
+		size += e.Len
+		if m.Size != size {
+			return fmt.Errorf("%w: size %d, data %d", ErrCorruptMeta, m.Size, size)
+		}
+	} else if m.Size > size || m.Size <= size-blockSize {
+		return fmt.Errorf("%w: size %d, data %d", ErrCorruptMeta, m.Size, size)
+	}
+	return nil
+}
+
+func (m Meta) marshal() []byte {
+	buf := make([]byte, 1, 32+len(m.Name)+len(m.Positions)+len(m.SmallData))
+	buf[0] = metaVersion
+	buf = putString(buf, m.Name)
+	buf = putVarint(buf, m.Size)
+	buf = putString(buf, string(m.Positions))
+	buf = putVarint(buf, m.CreateTime)
+	buf = putVarint(buf, m.ModTime)
+	buf = putString(buf, string(m.SmallData))
+	buf = append(buf, uint32ToBytes(m.Crc32)...)
+	buf = putVarint(buf, m.Generation)
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = putUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = putString(putString(buf, k), m.Tags[k])
+	}
+	if m.Tail == nil {
+		return append(buf, 0)
+	}
+	buf = append(buf, 1)
+	buf = putUvarint(buf, uint64(m.Tail.Block))
+	buf = putUvarint(buf, uint64(m.Tail.Off))
+	return putUvarint(buf, uint64(m.Tail.Len))
+}
+
+func putVarint(b []byte, v int64) []byte {
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	n := binary.PutVarint(b[len(b)-10:], v)
+	return b[:len(b)-10+n]
+}
+
+func putString(b []byte, s string) []byte {
+	return append(putUvarint(b, uint64(len(s))), s...)
+}
+
+// metaDecoder reads fields of a binary meta, the first error sticks.
+type metaDecoder struct {
+	p   []byte
+	err error
+}
+
+func (d *metaDecoder) fail(what string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: truncated %s", ErrCorruptMeta, what)
+	}
+	d.p = nil
+}
+
+func (d *metaDecoder) uvarint(what string) uint64 {
+	v, n := binary.Uvarint(d.p)
+	if n <= 0 {
+		d.fail(what)
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *metaDecoder) varint(what string) int64 {
+	v, n := binary.Varint(d.p)
+	if n <= 0 {
+		d.fail(what)
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *metaDecoder) next(what string) []byte {
+	n := d.uvarint(what)
+	if n > uint64(len(d.p)) {
+		d.fail(what)
+		return nil
+	}
+	v := d.p[:n]
+	d.p = d.p[n:]
+	return v
+}
+
+// bytes returns a copy, as the decoded buffer belongs to the transaction.
+func (d *metaDecoder) bytes(what string) []byte {
+	if v := d.next(what); len(v) > 0 {
+		return append([]byte(nil), v...)
+	}
+	return nil
+}
+
+func (d *metaDecoder) string(what string) string {
+	return string(d.next(what))
+}
+
+func (d *metaDecoder) byte(what string) byte {
+	if len(d.p) == 0 {
+		d.fail(what)
+		return 0
+	}
+	v := d.p[0]
+	d.p = d.p[1:]
+	return v
+}
+
+func decodeMeta(p []byte) (Meta, error) {
+	d := &metaDecoder{p: p}
+	m := Meta{
+		Name:       d.string("name"),
+		Size:       d.varint("size"),
+		Positions:  d.bytes("positions"),
+		CreateTime: d.varint("create time"),
+		ModTime:    d.varint("mod time"),
+		SmallData:  d.bytes("small data"),
+	}
+	if crc := d.p; len(crc) < 4 {
+		d.fail("crc32")
+	} else {
+		m.Crc32, d.p = bytesToUint32(crc), crc[4:]
+	}
+	m.Generation = d.varint("generation")
+	if n := d.uvarint("tags"); n > uint64(len(d.p)) {
+		d.fail("tags")
+	} else if n > 0 {
+		m.Tags = make(map[string]string, n)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			k := d.string("tag")
+			m.Tags[k] = d.string("tag")
+		}
+	}
+	if d.byte("tail") == 1 {
+		m.Tail = &Extent{
+			Block: uint32(d.uvarint("tail")),
+			Off:   int64(d.uvarint("tail")),
+			Len:   int64(d.uvarint("tail")),
+		}
+	}
+	if d.err == nil && len(d.p) > 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", ErrCorruptMeta, len(d.p))
+	}
+	return m, d.err
+}
+
+// MigrateMetas rewrites metas stored in an older encoding and returns their
+// number. Such metas are converted transparently when read, migrating saves
+// the cost of doing it every time.
+func (p *Package) MigrateMetas(ctx context.Context) (n int, err error) {
+	legacy := func(k, v []byte) bool {
+		return len(v) > 0 && v[0] != metaVersion && !bytes.HasPrefix(k, []byte("*:")) && !bytes.Equal(k, uploadInfoKey)
+	}
+	// convert rewrites legacy metas of bk, up to 1000 of them at once so
+	// transactions stay small, and returns the key to continue from.
+	convert := func(bk *bbolt.Bucket, from []byte) ([]byte, error) {
+		var keys, values [][]byte
+		c := bk.Cursor()
+		k, v := c.First()
+		if from != nil {
+			k, v = c.Seek(from)
+		}
+		for ; k != nil && len(keys) < 1000; k, v = c.Next() {
+			if v != nil && legacy(k, v) {
+				m, err := unmarshalMeta(v, p.blockSize)
+				if err != nil {
+					return nil, fmt.Errorf("migrate %q: %w", k, err)
+				}
+				keys, values = append(keys, append([]byte(nil), k...)), append(values, m.marshal())
+			}
+		}
+		if k != nil {
+			k = append([]byte(nil), k...)
+		}
+		for i := range keys {
+			if err := bk.Put(keys[i], values[i]); err != nil {
+				return nil, err
+			}
+		}
+		n += len(keys)
+		return k, nil
+	}
+
+	var from []byte
+	for first := true; first || from != nil; first = false {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if err := p.db.Update(func(tx *bbolt.Tx) (err error) {
+			from, err = convert(tx.Bucket(trunkBucket), from)
+			return err
+		}); err != nil {
+			return n, err
+		}
+	}
+	// Parts of pending uploads
+	err = p.db.Update(func(tx *bbolt.Tx) error {
+		uploads := tx.Bucket(uploadsBucket)
+		return uploads.ForEach(func(id, _ []byte) error {
+			bk := uploads.Bucket(id)
+			if bk == nil {
+				return nil
+			}
+			for from := []byte(nil); ; {
+				var err error
+				if from, err = convert(bk, from); err != nil || from == nil {
+					return err
+				}
+			}
+		})
+	})
+	return n, err
+}
@@ -0,0 +1,223 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+
+	"go.etcd.io/bbolt"
+)
+
+var errRelocateConflict = fmt.Errorf("relocate: meta changed")
+
+// Compact packs tails of sparse shared blocks together, moves data stored
+// after the first hole of the data file into free blocks before it, then
+// shrinks the data file.
+func (p *Package) Compact(ctx context.Context) error {
+	// Moved data must not go into drained blocks until compaction ends
+	defer p.alloc.undrain()
+	drained := p.alloc.drain(func(b uint32, mask uint64) bool {
+		return bits.OnesCount64(mask) <= slotsPerBlock/2
+	})
+	if err := p.compactTails(ctx, drained); err != nil {
+		return err
+	}
+
+	var used int64
+	p.db.View(func(tx *bbolt.Tx) error {
+		used = loadBitmap(tx).Count()
+		return nil
+	})
+	drained = p.alloc.drain(func(b uint32, mask uint64) bool {
+		return int64(b) >= used
+	})
+
+	var moves, tails []Meta
+	if err := p.ForEachMetaContext(ctx, "/", func(m Meta) error {
+		high := false
+		m.Positions.ForEach(func(v uint32) error {
+			if high = int64(v) >= used; high {
+				return ErrAbort
+			}
+			return nil
+		})
+		if high {
+			moves = append(moves, m)
+		} else if m.Tail != nil && drained[m.Tail.Block] {
+			tails = append(tails, m)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, m := range moves {
+		if err := p.relocate(ctx, m.Name, &claim{fill: true}); err != nil {
+			return err
+		}
+	}
+	for _, m := range tails {
+		if err := p.relocateTail(m); err != nil {
+			return err
+		}
+	}
+	p.alloc.release(space{}, p.trimData)
+	return nil
+}
+
+// ReclaimFreeSpace punches holes for all free blocks of the data file, which
+// releases the disk space of blocks freed while PunchHoles was not enabled.
+func (p *Package) ReclaimFreeSpace() error {
+	h, ok := p.store.(holePuncher)
+	if !ok {
+		return ErrPunchUnsupported
+	}
+	return p.alloc.sweep(h.PunchHole)
+}
+
+// DropSegment removes segment file i of a segmented package, which must not
+// hold any block in use, so it can be archived or deleted. Its blocks remain
+// free and the file is created again once they are reused.
+func (p *Package) DropSegment(i int) error {
+	s, ok := p.store.(*segmentStore)
+	if !ok {
+		return fmt.Errorf("drop segment: package is not segmented")
+	}
+	a := &p.alloc
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for b := int64(i) * s.segBlocks; b < int64(i+1)*s.segBlocks; b++ {
+		if a.isUsed(uint32(b)) {
+			return fmt.Errorf("drop segment %d: %w", i, ErrSegmentInUse)
+		}
+	}
+	return s.drop(i)
+}
+
+// relocate rewrites data of key into blocks of claim c, the rest of the meta
+// is left untouched. Data is read from a snapshot so its blocks cannot be
+// reused meanwhile, files changed before the commit are skipped.
+func (p *Package) relocate(ctx context.Context, key string, c *claim) error {
+	var m, n Meta
+	var reserved space
+	err := p.snapshot(func(tx *bbolt.Tx) error {
+		var err error
+		if m, err = p.infoTx(tx, key); err != nil || m.IsDir {
+			return errRelocateConflict
+		}
+		r, err := p.openMeta(m)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if reserved, err = p.ioCopy(ctx, &n, r, c); err != nil {
+			return err
+		}
+		if n.Crc32 != m.Crc32 {
+			p.alloc.release(reserved, p.trimData)
+			return fmt.Errorf("relocate %q: checksum mismatch", key)
+		}
+		return nil
+	})
+	if err == nil {
+		err = p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
+			cur, err := p.infoTx(tx, key)
+			if err != nil || cur.Generation != m.Generation {
+				return errRelocateConflict
+			}
+			st.freed.add(cur)
+			cur.Positions, cur.Tail = n.Positions, n.Tail
+			return tx.Bucket(trunkBucket).Put([]byte(key), cur.marshal())
+		})
+	}
+	if err == errRelocateConflict {
+		return nil
+	}
+	return err
+}
+
+// FragmentationReport describes how scattered files and free space are in
+// the data file.
+type FragmentationReport struct {
+	Files      []FileFragments
+	UsedBlocks int64
+	FreeBlocks int64     // free blocks before the last used one
+	Holes      [32]int64 // number of holes of 2^i to 2^(i+1)-1 free blocks
+}
+
+// FileFragments tells in how many extents the data of a file is stored, a
+// packed tail counts as one.
+type FileFragments struct {
+	Name    string
+	Blocks  int64
+	Extents int
+}
+
+// Fragmentation reports fragments of files under prefix, files kept in their
+// metas are left out, and holes of the whole data file.
+func (p *Package) Fragmentation(prefix string) (r FragmentationReport, err error) {
+	err = p.ForEachMeta(prefix, func(m Meta) error {
+		f := FileFragments{Name: m.Name}
+		m.Positions.ForEachRun(func(_, n uint32) error {
+			f.Blocks += int64(n)
+			f.Extents++
+			return nil
+		})
+		if m.Tail != nil {
+			f.Extents++
+		}
+		if f.Extents > 0 {
+			r.Files = append(r.Files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+	var used FreeBitmap
+	p.db.View(func(tx *bbolt.Tx) error {
+		used = loadBitmap(tx)
+		return nil
+	})
+	hole := 0
+	for b := int64(0); b < used.Last(); b++ {
+		if used[b/8]>>(b%8)&1 == 1 {
+			if hole > 0 {
+				r.Holes[bits.Len(uint(hole))-1]++
+			}
+			hole = 0
+			r.UsedBlocks++
+			continue
+		}
+		hole++
+		r.FreeBlocks++
+	}
+	return r, nil
+}
+
+// Defragment rewrites data of files keys stored in more than one run of
+// blocks into a single run if possible, so they can be read sequentially.
+// Files modified in the meantime are skipped.
+func (p *Package) Defragment(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, err := p.Info(key)
+		if err != nil {
+			return fmt.Errorf("defragment %q: %w", key, err)
+		}
+		runs := 0
+		m.Positions.ForEachRun(func(_, _ uint32) error {
+			runs++
+			return nil
+		})
+		if runs <= 1 {
+			continue
+		}
+		if err := p.relocate(ctx, m.Name, p.newClaim(m.Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
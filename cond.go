@@ -0,0 +1,126 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"go.etcd.io/bbolt"
+)
+
+// Precondition tests the current meta of a key before it is modified, m is
+// nil if the key doesn't exist.
+type Precondition func(m *Meta) bool
+
+func IfNotExists() Precondition {
+	return func(m *Meta) bool { return m == nil }
+}
+
+// IfGenerationMatch requires the key to be at generation gen, 0 means the key
+// must not exist.
+func IfGenerationMatch(gen int64) Precondition {
+	return func(m *Meta) bool {
+		if gen == 0 {
+			return m == nil
+		}
+		return m != nil && m.Generation == gen
+	}
+}
+
+func IfCrc32Match(crc uint32) Precondition {
+	return func(m *Meta) bool { return m != nil && m.Crc32 == crc }
+}
+
+func IfETagMatch(etag string) Precondition {
+	return func(m *Meta) bool { return m != nil && m.ETag() == etag }
+}
+
+func checkPreconditions(m *Meta, conds []Precondition) error {
+	for _, c := range conds {
+		if !c(m) {
+			return ErrPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// Conditional performs operations only if all its preconditions hold when
+// committing, otherwise ErrPreconditionFailed is returned.
+type Conditional struct {
+	p     *Package
+	conds []Precondition
+}
+
+func (p *Package) If(conds ...Precondition) *Conditional {
+	return &Conditional{p: p, conds: conds}
+}
+
+func (c *Conditional) WriteAll(key string, value []byte, kvs ...string) error {
+	return c.Write(key, bytes.NewReader(value), kvs...)
+}
+
+func (c *Conditional) Write(key string, value io.Reader, kvs ...string) error {
+	return c.WriteContext(context.Background(), key, value, kvs...)
+}
+
+func (c *Conditional) WriteContext(ctx context.Context, key string, value io.Reader, kvs ...string) error {
+	// Avoid uploading data which is going to be rejected anyway
+	if err := c.p.db.View(func(tx *bbolt.Tx) error {
+		m, err := c.p.infoTx(tx, key)
+		switch {
+		case err == ErrNotFound:
+			return checkPreconditions(nil, c.conds)
+		case err != nil || m.IsDir:
+			return nil // reported by prepareWrite
+		}
+		return checkPreconditions(&m, c.conds)
+	}); err != nil {
+		return err
+	}
+	op, reserved, err := c.p.prepareWrite(ctx, key, value, kvs)
+	if err != nil {
+		return err
+	}
+	return c.p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
+		return c.p.writeTx(tx, st, op, c.conds)
+	})
+}
+
+func (c *Conditional) Append(key string, value io.Reader) error {
+	return c.p.appendIf(context.Background(), key, value, c.conds)
+}
+
+func (c *Conditional) AppendContext(ctx context.Context, key string, value io.Reader) error {
+	return c.p.appendIf(ctx, key, value, c.conds)
+}
+
+func (c *Conditional) Delete(key string) error {
+	op, err := c.p.newOp(OpDelete, key, "")
+	if err != nil {
+		return err
+	}
+	return c.p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return c.p.deleteTx(tx, st, op, c.conds)
+	})
+}
+
+// Move checks preconditions against oldname.
+func (c *Conditional) Move(oldname, newname string, overwrite bool) error {
+	op, err := c.p.newOp(OpMove, newname, oldname)
+	if err != nil {
+		return err
+	}
+	return c.p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return c.p.moveTx(tx, st, op, overwrite, c.conds)
+	})
+}
+
+func (c *Conditional) UpdateTags(key string, f func(map[string]string) error) error {
+	op, err := c.p.newOp(OpUpdateTags, key, "")
+	if err != nil {
+		return err
+	}
+	return c.p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return c.p.updateTagsTx(tx, st, op, f, c.conds)
+	})
+}
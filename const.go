@@ -8,12 +8,21 @@ const (
 )
 
 var (
-	trunkBucket = []byte("trunk")
+	trunkBucket   = []byte("trunk")
+	changesBucket = []byte("changes")
+	uploadsBucket = []byte("uploads")
+	packedBucket  = []byte("packed")
+	freeBucket    = []byte("free")
 
 	dataFileKey   = []byte("*:datafile")
 	totalSizeKey  = []byte("*:size")
 	totalCountKey = []byte("*:count")
 	freeKey       = []byte("*:free")
+	generationKey = []byte("*:gen")
+
+	blockSizeKey      = []byte("*:blocksize")
+	smallThresholdKey = []byte("*:small")
+	segmentSizeKey    = []byte("*:segsize")
 )
 
 var (
@@ -21,4 +30,11 @@ var (
 	ErrInvalidName = fmt.Errorf("invalid name")
 	ErrNotFound    = fmt.Errorf("not found")
 	ErrIsDirectory = fmt.Errorf("directory operation not permitted")
+
+	ErrPreconditionFailed = fmt.Errorf("precondition failed")
+	ErrNoSuchUpload       = fmt.Errorf("no such upload")
+	ErrCorruptMeta        = fmt.Errorf("corrupt meta")
+	errCorruptBlocks      = fmt.Errorf("%w: invalid block list", ErrCorruptMeta)
+	ErrPunchUnsupported   = fmt.Errorf("punching holes not supported by the store")
+	ErrSegmentInUse       = fmt.Errorf("segment in use")
 )
@@ -0,0 +1,317 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type TagMode int
+
+const (
+	TagsNone     TagMode = iota
+	TagsXattr            // store tags as "user.<key>" extended attributes
+	TagsManifest         // store tags of all files in ManifestName under the export root
+)
+
+const ManifestName = ".vfs-tags.json"
+
+// DirOptions controls ImportDir and ExportDir, the zero value copies every file.
+type DirOptions struct {
+	// Include and Exclude are path.Match patterns tested against both the slash
+	// separated path relative to the root and the base name of a file.
+	Include []string
+	Exclude []string
+
+	// SkipUnchanged skips files whose destination has the same size, mod time
+	// and CRC32 as the source.
+	SkipUnchanged bool
+
+	// Workers is the number of files copied in parallel, default to NumCPU.
+	Workers int
+
+	// Progress is called after every file, never concurrently.
+	Progress func(Progress)
+
+	// Tags tells ExportDir how to store tags.
+	Tags TagMode
+}
+
+type Progress struct {
+	Name    string // name in the package
+	Size    int64
+	Skipped bool
+	Files   int64 // files processed so far, including this one
+	Bytes   int64 // bytes copied so far
+}
+
+func (o *DirOptions) match(rel string) bool {
+	test := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(p, path.Base(rel)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(o.Include) > 0 && !test(o.Include) {
+		return false
+	}
+	return !test(o.Exclude)
+}
+
+// parallel runs f on every job with opts.Workers goroutines, stopping at
+// the first error.
+func (o *DirOptions) parallel(ctx context.Context, jobs func(ctx context.Context, ch chan<- string) error, f func(ctx context.Context, job string) (Progress, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		total    Progress
+		wg       sync.WaitGroup
+		ch       = make(chan string)
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range ch {
+				pg, err := f(ctx, job)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				mu.Lock()
+				total.Files++
+				if !pg.Skipped {
+					total.Bytes += pg.Size
+				}
+				pg.Files, pg.Bytes = total.Files, total.Bytes
+				if o.Progress != nil {
+					o.Progress(pg)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := jobs(ctx, ch)
+	close(ch)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func fileCrc32(name string) (uint32, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	_, err = io.Copy(h, f)
+	return h.Sum32(), err
+}
+
+// ImportDir writes all regular files under osDir into prefix, keeping their
+// mod times.
+func (p *Package) ImportDir(ctx context.Context, osDir, prefix string, opts DirOptions) error {
+	return opts.parallel(ctx, func(ctx context.Context, ch chan<- string) error {
+		return filepath.Walk(osDir, func(fn string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(osDir, fn)
+			if err != nil {
+				return err
+			}
+			if !opts.match(filepath.ToSlash(rel)) {
+				return nil
+			}
+			select {
+			case ch <- rel:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}, func(ctx context.Context, rel string) (Progress, error) {
+		fn := filepath.Join(osDir, rel)
+		key := path.Join("/", prefix, filepath.ToSlash(rel))
+		info, err := os.Stat(fn)
+		if err != nil {
+			return Progress{}, err
+		}
+		pg := Progress{Name: key, Size: info.Size()}
+
+		if opts.SkipUnchanged {
+			if m, err := p.Info(key); err == nil && m.Size == info.Size() && m.ModTime == info.ModTime().Unix() {
+				if crc, err := fileCrc32(fn); err == nil && crc == m.Crc32 {
+					pg.Skipped = true
+					return pg, nil
+				}
+			}
+		}
+
+		f, err := os.Open(fn)
+		if err != nil {
+			return pg, err
+		}
+		defer f.Close()
+
+		if err := p.writeWithModTime(ctx, key, f, info.ModTime().Unix(), nil); err != nil {
+			return pg, fmt.Errorf("import %s: %v", fn, err)
+		}
+		return pg, nil
+	})
+}
+
+// ExportDir writes all files under prefix into osDir, restoring their mod
+// times and optionally their tags.
+func (p *Package) ExportDir(ctx context.Context, prefix, osDir string, opts DirOptions) error {
+	prefix = path.Join("/", prefix)
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	var manifest map[string]map[string]string
+	var mu sync.Mutex
+	if opts.Tags == TagsManifest {
+		manifest = map[string]map[string]string{}
+	}
+
+	if err := opts.parallel(ctx, func(ctx context.Context, ch chan<- string) error {
+		var names []string
+		if err := p.ForEachMetaContext(ctx, prefix, func(m Meta) error {
+			if opts.match(m.Name[len(prefix):]) {
+				names = append(names, m.Name)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, name := range names {
+			select {
+			case ch <- name:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}, func(ctx context.Context, name string) (Progress, error) {
+		m, err := p.Info(name)
+		if err != nil {
+			return Progress{}, err
+		}
+		rel := m.Name[len(prefix):]
+		fn := filepath.Join(osDir, filepath.FromSlash(rel))
+		pg := Progress{Name: m.Name, Size: m.Size}
+
+		if manifest != nil && len(m.Tags) > 0 {
+			mu.Lock()
+			manifest[rel] = m.Tags
+			mu.Unlock()
+		}
+
+		if opts.SkipUnchanged {
+			if info, err := os.Stat(fn); err == nil && info.Size() == m.Size && info.ModTime().Unix() == m.ModTime {
+				if crc, err := fileCrc32(fn); err == nil && crc == m.Crc32 {
+					pg.Skipped = true
+					return pg, nil
+				}
+			}
+		}
+
+		if err := p.exportFile(ctx, m, fn); err != nil {
+			return pg, fmt.Errorf("export %s: %v", m.Name, err)
+		}
+		if opts.Tags == TagsXattr {
+			for k, v := range m.Tags {
+				if err := setxattr(fn, "user."+k, v); err != nil {
+					return pg, fmt.Errorf("export %s: %v", m.Name, err)
+				}
+			}
+		}
+		return pg, nil
+	}); err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		buf, _ := json.MarshalIndent(manifest, "", "  ")
+		return os.WriteFile(filepath.Join(osDir, ManifestName), buf, 0666)
+	}
+	return nil
+}
+
+func (p *Package) exportFile(ctx context.Context, m Meta, fn string) error {
+	r, err := p.Open(m.Name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, &ctxReader{ctx, r}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	mt := time.Unix(m.ModTime, 0)
+	return os.Chtimes(fn, mt, mt)
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,96 @@
+package vfs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Durability tells how data is flushed to disk before the metas referencing
+// it are committed. The index is always synced on commit.
+type Durability int
+
+const (
+	// DurabilityStrict syncs the data of every write before committing it,
+	// so the index never references data lost by a power failure.
+	DurabilityStrict Durability = iota
+	// DurabilityBatched is DurabilityStrict where concurrent writes share
+	// their syncs, trading some latency for throughput.
+	DurabilityBatched
+	// DurabilityNone never syncs data, a power failure may leave recently
+	// committed files with corrupted contents. Package.Sync flushes them.
+	DurabilityNone
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityStrict:
+		return "strict"
+	case DurabilityBatched:
+		return "batched"
+	case DurabilityNone:
+		return "none"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// syncGroup runs a sync for all callers waiting for one, every caller gets
+// the result of a sync started after it called.
+type syncGroup struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started uint64
+	done    uint64
+	running bool
+	err     error
+}
+
+func (g *syncGroup) sync(f func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mu)
+	}
+	// A sync already running may have started before our data was written
+	want := g.started + 1
+	for g.done < want {
+		if g.running {
+			g.cond.Wait()
+			continue
+		}
+		g.running = true
+		g.started++
+		n := g.started
+		g.mu.Unlock()
+		err := f()
+		g.mu.Lock()
+		g.running = false
+		g.done, g.err = n, err
+		g.cond.Broadcast()
+	}
+	return g.err
+}
+
+// syncData makes data written so far durable according to the durability
+// mode, it is called before committing metas which reference new data.
+func (p *Package) syncData() error {
+	var err error
+	switch p.durability {
+	case DurabilityStrict:
+		err = p.store.Sync()
+	case DurabilityBatched:
+		err = p.syncs.sync(p.store.Sync)
+	}
+	if err != nil {
+		return fmt.Errorf("sync data: %v", err)
+	}
+	return nil
+}
+
+// Sync flushes the data file and the index to disk, making all committed
+// changes durable whatever the durability mode is.
+func (p *Package) Sync() error {
+	if err := p.syncs.sync(p.store.Sync); err != nil {
+		return fmt.Errorf("sync data: %v", err)
+	}
+	return p.db.Sync()
+}
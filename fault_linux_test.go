@@ -0,0 +1,33 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+const canBreakFiles = true
+
+// breakFile makes writes and resizes of f fail until the returned function is
+// called, by putting a read-only descriptor of the same file in place of its
+// own, reads and mappings keep working.
+func breakFile(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	saved, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	ro, err := syscall.Open(f.Name(), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		syscall.Close(saved)
+		return nil, err
+	}
+	defer syscall.Close(ro)
+	if err := syscall.Dup3(ro, fd, syscall.O_CLOEXEC); err != nil {
+		syscall.Close(saved)
+		return nil, err
+	}
+	return func() {
+		syscall.Dup3(saved, fd, syscall.O_CLOEXEC)
+		syscall.Close(saved)
+	}, nil
+}
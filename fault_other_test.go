@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+// canBreakFiles is false as index faults need Linux only syscalls, crash
+// tests injecting them are skipped.
+const canBreakFiles = false
+
+func breakFile(f *os.File) (func(), error) {
+	return nil, errors.New("breaking files is not supported")
+}
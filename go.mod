@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/tidwall/gjson v1.8.0
 	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.11.0
 )
@@ -0,0 +1,106 @@
+package vfs
+
+import "log"
+
+// Operation describes a call seen by hooks.
+type Operation struct {
+	Op      Op
+	Name    string
+	OldName string            // source of OpMove
+	Tags    map[string]string // tags to be stored by OpWrite and OpUpdateTags, Before may amend them
+	Head    []byte            // first bytes of data written by OpWrite
+
+	// Meta is the committed meta when calling After, nil for OpDelete.
+	// Hooks running in the transaction also see the current meta of Name,
+	// if any, in Before.
+	Meta *Meta
+
+	m Meta // the meta about to be written by OpWrite
+}
+
+// Hook intercepts operations on a Package. Hooks run outside of transactions
+// unless they have an InTx method returning true, then they run inside the
+// write transaction and an error from After aborts it. Hooks of OpOpen always
+// run outside of transactions.
+//
+// After hooks running outside of transactions are called once op has taken
+// effect, like a change being committed, so their errors cannot undo it: all
+// of them run and their errors go to OpenOptions.HookError instead of being
+// returned by the operation.
+type Hook interface {
+	// Before is called before op takes effect, returning an error rejects it.
+	Before(op *Operation) error
+	// After is called once op has taken effect.
+	After(op *Operation) error
+}
+
+// HookFuncs adapts functions to Hook, nil functions are skipped.
+type HookFuncs struct {
+	BeforeFunc func(op *Operation) error
+	AfterFunc  func(op *Operation) error
+	Tx         bool
+}
+
+func (h HookFuncs) Before(op *Operation) error {
+	if h.BeforeFunc == nil {
+		return nil
+	}
+	return h.BeforeFunc(op)
+}
+
+func (h HookFuncs) After(op *Operation) error {
+	if h.AfterFunc == nil {
+		return nil
+	}
+	return h.AfterFunc(op)
+}
+
+func (h HookFuncs) InTx() bool {
+	return h.Tx
+}
+
+// hookInTx tells whether h runs on op inside the transaction, hooks of
+// OpOpen always run outside.
+func hookInTx(h Hook, op *Operation) bool {
+	t, ok := h.(interface{ InTx() bool })
+	return ok && t.InTx() && op.Op != OpOpen
+}
+
+func (p *Package) before(tx bool, op *Operation) error {
+	for _, h := range p.hooks {
+		if hookInTx(h, op) == tx {
+			if err := h.Before(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// committed runs hooks outside of transactions after op has taken effect,
+// reporting their errors to the hook error handler.
+func (p *Package) committed(op *Operation) {
+	for _, h := range p.hooks {
+		if !hookInTx(h, op) {
+			if err := h.After(op); err != nil {
+				p.hookError(op, err)
+			}
+		}
+	}
+}
+
+func (p *Package) after(tx bool, op *Operation) error {
+	for _, h := range p.hooks {
+		if hookInTx(h, op) == tx {
+			if err := h.After(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logHookError is the default OpenOptions.HookError.
+func logHookError(op *Operation, err error) {
+	log.Printf("vfs: after %s %q: %v", op.Op, op.Name, err)
+}
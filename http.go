@@ -0,0 +1,178 @@
+package vfs
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ContentTypeTag is the tag holding the content type of a file, served by
+// Handler and set from the Content-Type header of PUT requests.
+const ContentTypeTag = "content-type"
+
+// Handler serves files of a Package over HTTP. GET and HEAD support ranges
+// and conditional requests, directories are listed as HTML.
+type Handler struct {
+	Package *Package
+	Prefix  string // root of the served files in the package
+
+	// Writable enables PUT and DELETE, both honor If-Match and
+	// If-None-Match.
+	Writable bool
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Cleaning the request path first keeps ".." from climbing above the
+	// prefix, requests using it are rejected anyway
+	prefix := path.Join("/", h.Prefix)
+	key := path.Join(prefix, path.Clean("/"+r.URL.Path))
+	if strings.Contains("/"+r.URL.Path+"/", "/../") || key != prefix && !strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.serveGet(w, r, key)
+	case http.MethodPut, http.MethodDelete:
+		if !h.Writable {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodPut {
+			h.servePut(w, r, key)
+		} else {
+			h.serveDelete(w, r, key)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) serveGet(w http.ResponseWriter, r *http.Request, key string) {
+	if key == "/" {
+		h.serveDir(w, r, key)
+		return
+	}
+	// Blocks stay pinned while serving, so the body is the version the
+	// ETag describes even if the file is rewritten meanwhile
+	h.Package.alloc.pin()
+	defer h.Package.alloc.unpin()
+	f, m, err := h.Package.open(key)
+	if err == ErrIsDirectory {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		h.serveDir(w, r, key)
+		return
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", `"`+m.ETag()+`"`)
+	if ct := m.Tags[ContentTypeTag]; ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	http.ServeContent(w, r, path.Base(key), time.Unix(m.ModTime, 0), f)
+}
+
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, key string) {
+	metas, err := h.Package.ListContext(r.Context(), key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, m := range metas {
+		name := path.Base(m.Name)
+		if m.IsDir {
+			name += "/"
+		}
+		u := url.URL{Path: name}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", u.String(), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+func (h *Handler) servePut(w http.ResponseWriter, r *http.Request, key string) {
+	var kvs []string
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		kvs = append(kvs, ContentTypeTag, ct)
+	}
+	existed := false
+	conds := append(headerConds(r.Header), func(m *Meta) bool {
+		existed = m != nil
+		return true
+	})
+	if err := h.Package.If(conds...).WriteContext(r.Context(), key, r.Body, kvs...); err != nil {
+		httpError(w, err)
+		return
+	}
+	if m, err := h.Package.Info(key); err == nil {
+		w.Header().Set("ETag", `"`+m.ETag()+`"`)
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (h *Handler) serveDelete(w http.ResponseWriter, r *http.Request, key string) {
+	if err := h.Package.If(headerConds(r.Header)...).Delete(key); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// headerConds converts If-Match and If-None-Match to preconditions. Both take
+// "*" or a list of entity tags, weak tags are compared by their value.
+func headerConds(h http.Header) []Precondition {
+	var conds []Precondition
+	if v := h.Get("If-Match"); v != "" {
+		tags := etagList(v)
+		conds = append(conds, func(m *Meta) bool { return m != nil && (tags == nil || tags[m.ETag()]) })
+	}
+	if v := h.Get("If-None-Match"); v != "" {
+		tags := etagList(v)
+		conds = append(conds, func(m *Meta) bool { return m == nil || tags != nil && !tags[m.ETag()] })
+	}
+	return conds
+}
+
+// etagList parses a header value listing entity tags, nil means "*".
+func etagList(v string) map[string]bool {
+	if strings.TrimSpace(v) == "*" {
+		return nil
+	}
+	tags := map[string]bool{}
+	for _, t := range strings.Split(v, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		tags[strings.Trim(t, `"`)] = true
+	}
+	return tags
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case ErrNotFound:
+		code = http.StatusNotFound
+	case ErrInvalidName:
+		code = http.StatusBadRequest
+	case ErrIsDirectory:
+		code = http.StatusConflict
+	case ErrPreconditionFailed:
+		code = http.StatusPreconditionFailed
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -1,6 +1,8 @@
 package vfs
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"path/filepath"
 	"strings"
@@ -9,14 +11,22 @@ import (
 )
 
 func (p *Package) ForEach(toplevel string, f func(Meta, io.Reader) error) error {
-	return p.forEachImpl(toplevel, true, func(m Meta, r io.Reader) error { return f(m, r) })
+	return p.ForEachContext(context.Background(), toplevel, f)
 }
 
 func (p *Package) ForEachMeta(toplevel string, f func(Meta) error) error {
-	return p.forEachImpl(toplevel, false, func(m Meta, r io.Reader) error { return f(m) })
+	return p.ForEachMetaContext(context.Background(), toplevel, f)
 }
 
-func (p *Package) forEachImpl(toplevel string, reader bool, f func(Meta, io.Reader) error) error {
+func (p *Package) ForEachContext(ctx context.Context, toplevel string, f func(Meta, io.Reader) error) error {
+	return p.forEachImpl(ctx, toplevel, true, func(m Meta, r io.Reader) error { return f(m, r) })
+}
+
+func (p *Package) ForEachMetaContext(ctx context.Context, toplevel string, f func(Meta) error) error {
+	return p.forEachImpl(ctx, toplevel, false, func(m Meta, r io.Reader) error { return f(m) })
+}
+
+func (p *Package) forEachImpl(ctx context.Context, toplevel string, reader bool, f func(Meta, io.Reader) error) error {
 	toplevel = strings.TrimSuffix(toplevel, "/") + "/"
 	return p.db.View(func(tx *bbolt.Tx) error {
 		c := tx.Bucket(trunkBucket).Cursor()
@@ -25,8 +35,11 @@ func (p *Package) forEachImpl(toplevel string, reader bool, f func(Meta, io.Read
 			k, v = c.Seek([]byte(toplevel))
 		}
 		for ; len(k) > 0; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			sk := string(k)
-			if strings.HasPrefix(sk, "*:") {
+			if strings.HasPrefix(sk, "*:") || strings.HasSuffix(sk, "/") {
 				continue
 			}
 			if !strings.HasPrefix(sk, toplevel) {
@@ -37,7 +50,12 @@ func (p *Package) forEachImpl(toplevel string, reader bool, f func(Meta, io.Read
 				if err != nil {
 					return err
 				}
-				if err := f(unmarshalMeta(v), r); err != nil {
+				m, err := unmarshalMeta(v, p.blockSize)
+				if err != nil {
+					r.Close()
+					return fmt.Errorf("%q: %w", sk, err)
+				}
+				if err := f(m, r); err != nil {
 					r.Close()
 					if err == ErrAbort {
 						return nil
@@ -46,7 +64,11 @@ func (p *Package) forEachImpl(toplevel string, reader bool, f func(Meta, io.Read
 				}
 				r.Close()
 			} else {
-				if err := f(unmarshalMeta(v), nil); err != nil {
+				m, err := unmarshalMeta(v, p.blockSize)
+				if err != nil {
+					return fmt.Errorf("%q: %w", sk, err)
+				}
+				if err := f(m, nil); err != nil {
 					if err == ErrAbort {
 						return nil
 					}
@@ -59,11 +81,18 @@ func (p *Package) forEachImpl(toplevel string, reader bool, f func(Meta, io.Read
 }
 
 func (p *Package) Search(toplevel, name string, max int) (names []Meta, err error) {
+	return p.SearchContext(context.Background(), toplevel, name, max)
+}
+
+func (p *Package) SearchContext(ctx context.Context, toplevel, name string, max int) (names []Meta, err error) {
 	toplevel = strings.TrimSuffix(toplevel, "/") + "/"
 	dedup := map[string]bool{}
 	err = p.db.View(func(tx *bbolt.Tx) error {
 		c := tx.Bucket(trunkBucket).Cursor()
 		for k, v := c.Seek([]byte(toplevel)); len(k) > 0 && len(names) < max; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			sk := string(k)
 			if strings.HasPrefix(sk, "*:") {
 				continue
@@ -75,7 +104,17 @@ func (p *Package) Search(toplevel, name string, max int) (names []Meta, err erro
 				dir := filepath.Dir(sk)
 				fn := filepath.Base(sk)
 				if strings.Contains(fn, name) {
-					names = append(names, unmarshalMeta(v))
+					m, err := unmarshalMeta(v, p.blockSize)
+					if err != nil {
+						return fmt.Errorf("%q: %w", sk, err)
+					}
+					if !m.IsDir {
+						names = append(names, m)
+					} else if d := strings.TrimSuffix(sk, "/"); !dedup[d] {
+						// Empty directory created by Mkdir
+						dedup[d] = true
+						names = append(names, m)
+					}
 				} else if strings.Contains(dir, name) {
 					idx := strings.Index(dir, name)       // 1st: /root/www/xxx/yyyNAMEyyy/zzz
 					idx2 := strings.Index(dir[idx:], "/") // 2nd: NAMEyyy/zzz      ^
@@ -99,11 +138,18 @@ func (p *Package) Search(toplevel, name string, max int) (names []Meta, err erro
 }
 
 func (p *Package) List(path string) (names []Meta, err error) {
+	return p.ListContext(context.Background(), path)
+}
+
+func (p *Package) ListContext(ctx context.Context, path string) (names []Meta, err error) {
 	path = strings.TrimSuffix(path, "/") + "/"
 	err = p.db.View(func(tx *bbolt.Tx) error {
 		bk := tx.Bucket(trunkBucket)
 		c := bk.Cursor()
 		for k, v := c.Seek([]byte(path)); len(k) > 0; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			sk := string(k)
 			if strings.HasPrefix(sk, "*:") {
 				k, v = c.Next()
@@ -115,10 +161,23 @@ func (p *Package) List(path string) (names []Meta, err error) {
 			suffix := sk[len(path):]
 			if idx := strings.Index(suffix, "/"); idx > -1 {
 				d := Meta{Name: path + suffix[:idx+1], IsDir: true}
+				if sk == d.Name { // created by Mkdir, sorts before its children
+					m, err := unmarshalMeta(v, p.blockSize)
+					if err != nil {
+						return fmt.Errorf("%q: %w", sk, err)
+					}
+					d = m
+				}
 				names = append(names, d)
 				k, v = c.Seek([]byte(d.Name + "\xff"))
 			} else {
-				names = append(names, unmarshalMeta(v))
+				if suffix != "" { // skip the directory itself created by Mkdir
+					m, err := unmarshalMeta(v, p.blockSize)
+					if err != nil {
+						return fmt.Errorf("%q: %w", sk, err)
+					}
+					names = append(names, m)
+				}
 				k, v = c.Next()
 			}
 		}
@@ -0,0 +1,82 @@
+package vfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	bbolt "go.etcd.io/bbolt"
+)
+
+// OpenMemory opens an empty Package living in memory, it is gone once closed.
+// bbolt needs a file to map, so the index is a temporary file which is never
+// synced and removed on Close, data blocks are kept in a MemStore unless opts
+// provide another store.
+func OpenMemory(opts ...OpenOptions) (*Package, error) {
+	f, err := ioutil.TempFile("", "vfs-*.index")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	db, err := bbolt.Open(f.Name(), 0600, &bbolt.Options{NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	var o OpenOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Store == nil {
+		bs := o.BlockSize
+		if bs == 0 {
+			bs = BlockSize
+		}
+		o.Store = NewMemStore(bs)
+	}
+	p, err := openDB(db, "", []OpenOptions{o})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	p.dbpath, p.tmpIndex = "", true
+	return p, nil
+}
+
+// Persist dumps a consistent copy of the package to path, which can be opened
+// by Open afterwards. Only used blocks are copied, the unused ones are left as
+// holes in the data file.
+func (p *Package) Persist(path string) error {
+	path = strings.TrimSuffix(path, ".index")
+	return p.snapshot(func(tx *bbolt.Tx) error {
+		trunk := tx.Bucket(trunkBucket)
+		dst, err := openDataStore(p.fs, fmt.Sprintf("%s.%x.data", path, trunk.Get(dataFileKey)), p.blockSize, bytesToInt64(trunk.Get(segmentSizeKey))/p.blockSize)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		used := loadBitmap(tx)
+		buf := make([]byte, p.blockSize)
+		for b := int64(0); b < used.Last(); b++ {
+			if used[b/8]>>(b%8)&1 == 0 {
+				continue
+			}
+			if _, err := p.store.ReadBlock(uint32(b), 0, buf); err != nil {
+				return fmt.Errorf("persist block %d: %v", b, err)
+			}
+			if err := dst.WriteBlock(uint32(b), 0, buf); err != nil {
+				return err
+			}
+		}
+		if err := dst.Truncate(used.Last()); err != nil {
+			return err
+		}
+		if err := dst.Sync(); err != nil {
+			return err
+		}
+		return tx.CopyFile(path+".index", 0777)
+	})
+}
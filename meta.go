@@ -2,13 +2,11 @@ package vfs
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
+	"math/bits"
 	"strconv"
 	"strings"
 	"time"
-
-	"go.etcd.io/bbolt"
 )
 
 func bytesToInt64(p []byte) int64 {
@@ -40,28 +38,19 @@ func uint32ToBytes(v uint32) []byte {
 type Meta struct {
 	Name       string            `json:"n"`
 	Size       int64             `json:"sz"`
-	Positions  Blocks            `json:"pos"`
+	Positions  Blocks            `json:"ex"`
 	CreateTime int64             `json:"ct"`
 	ModTime    int64             `json:"mt"`
 	SmallData  []byte            `json:"R"`
 	Crc32      uint32            `json:"crc"`
 	Tags       map[string]string `json:"T"`
+	Generation int64             `json:"g"`
+	Tail       *Extent           `json:"tl,omitempty"` // data after the last full block
 
 	IsDir bool  `json:"-"`
 	Count int64 `json:"-"`
 }
 
-func unmarshalMeta(p []byte) Meta {
-	m := Meta{}
-	json.Unmarshal(p, &m)
-	return m
-}
-
-func (m Meta) marshal() []byte {
-	buf, _ := json.Marshal(m)
-	return buf
-}
-
 func (m Meta) String() string {
 	if m.Name == "" {
 		return "<invalid meta>"
@@ -69,62 +58,121 @@ func (m Meta) String() string {
 	if m.IsDir {
 		return fmt.Sprintf("<%q-%d-%d>", m.Name, m.Size, m.Count)
 	}
-	return fmt.Sprintf("<%q-%d-%08x-%v-%v-%v>", m.Name, m.Size, m.Crc32, m.Tags,
+	return fmt.Sprintf("<%q-%d-%08x-%d-%v-%v-%v>", m.Name, m.Size, m.Crc32, m.Generation, m.Tags,
 		time.Unix(m.CreateTime, 0).Format(time.ANSIC),
 		time.Unix(m.ModTime, 0).Format(time.ANSIC),
 	)
 }
 
+// ETag identifies the content and tags of a file, it changes whenever the
+// meta is modified.
+func (m Meta) ETag() string {
+	return fmt.Sprintf("%x-%08x", m.Generation, m.Crc32)
+}
+
+// Blocks lists block numbers as runs of consecutive blocks, every run is
+// encoded as the uvarints of its first block and its length.
 type Blocks []byte
 
+func putUvarint(b []byte, v uint64) []byte {
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	n := binary.PutUvarint(b[len(b)-10:], v)
+	return b[:len(b)-10+n]
+}
+
+// uvarintStart returns where the uvarint ending at end starts.
+func uvarintStart(b []byte, end int) int {
+	i := end - 1
+	for i > 0 && b[i-1]&0x80 != 0 {
+		i--
+	}
+	return i
+}
+
+// lastRun returns the offset of the length of the last run, its first block
+// and its length.
+func (b Blocks) lastRun() (int, uint32, uint32) {
+	if len(b) == 0 {
+		return 0, 0, 0
+	}
+	i := uvarintStart(b, len(b))
+	start, _ := binary.Uvarint(b[uvarintStart(b, i):i])
+	n, _ := binary.Uvarint(b[i:])
+	return i, uint32(start), uint32(n)
+}
+
 func (b *Blocks) Append(v uint32) {
-	*b = append(*b, 0, 0, 0, 0, 0)
-	n := binary.PutUvarint((*b)[len(*b)-5:], uint64(v))
-	*b = (*b)[:len(*b)-5+n]
+	if i, start, n := b.lastRun(); n > 0 && uint64(start)+uint64(n) == uint64(v) {
+		*b = putUvarint((*b)[:i], uint64(n)+1)
+		return
+	}
+	*b = putUvarint(putUvarint(*b, uint64(v)), 1)
 }
 
-func (b Blocks) ForEach(f func(v uint32) error) error {
+// ForEachRun calls f with the first block and the length of every run, it
+// fails with errCorruptBlocks if b is malformed.
+func (b Blocks) ForEachRun(f func(start, n uint32) error) error {
 	for x := b; len(x) > 0; {
-		v, n := binary.Uvarint(x)
-		if n == 0 {
-			break
+		start, n1 := binary.Uvarint(x)
+		if n1 <= 0 {
+			return errCorruptBlocks
 		}
-		assert(n > 0)
-		if err := f(uint32(v)); err != nil {
+		n, n2 := binary.Uvarint(x[n1:])
+		if n2 <= 0 || n == 0 || start+n > 1<<32 || start+n < start {
+			return errCorruptBlocks
+		}
+		if err := f(uint32(start), uint32(n)); err != nil {
 			return err
 		}
-		x = x[n:]
+		x = x[n1+n2:]
 	}
 	return nil
 }
 
-func (b Blocks) Last() (last uint32) {
-	b.ForEach(func(v uint32) error {
-		last = v
+func (b Blocks) ForEach(f func(v uint32) error) error {
+	return b.ForEachRun(func(start, n uint32) error {
+		for i := uint32(0); i < n; i++ {
+			if err := f(start + i); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	return
 }
 
+func (b Blocks) Last() uint32 {
+	_, start, n := b.lastRun()
+	if n == 0 {
+		return 0
+	}
+	return start + n - 1
+}
+
+// legacyBlocks converts a list of uvarint block numbers, the encoding of
+// Blocks in older metas, into runs.
+func legacyBlocks(p []byte) (b Blocks) {
+	for len(p) > 0 {
+		v, n := binary.Uvarint(p)
+		if n <= 0 {
+			break
+		}
+		b.Append(uint32(v))
+		p = p[n:]
+	}
+	return b
+}
+
+// String lists runs of block numbers, their offsets depend on the block size
+// of the package.
 func (b Blocks) String() string {
 	buf := make([]string, 0, len(b)/2)
-	b.ForEach(func(v uint32) error {
-		buf = append(buf, "0x"+strconv.FormatInt(int64(v)*BlockSize, 16))
+	b.ForEachRun(func(start, n uint32) error {
+		buf = append(buf, "#"+strconv.FormatInt(int64(start), 10)+"+"+strconv.FormatInt(int64(n), 10))
 		return nil
 	})
 	return "[" + strings.Join(buf, ",") + "]"
 }
 
-func (b Blocks) Free(tx *bbolt.Tx) error {
-	trunk := tx.Bucket(trunkBucket)
-	m := FreeBitmap(append([]byte{}, trunk.Get(freeKey)...))
-	b.ForEach(func(v uint32) error {
-		m.Free(v)
-		return nil
-	})
-	return trunk.Put(freeKey, m)
-}
-
 type FreeBitmap []byte
 
 func (b *FreeBitmap) Free(v uint32) {
@@ -135,11 +183,46 @@ func (b *FreeBitmap) Free(v uint32) {
 	}
 }
 
+func (b *FreeBitmap) Set(v uint32) {
+	idx := int(v / 8)
+	for len(*b) <= idx {
+		*b = append(*b, 0)
+	}
+	(*b)[idx] |= 1 << (v % 8)
+}
+
+func (b FreeBitmap) Count() (n int64) {
+	for _, v := range b {
+		n += int64(bits.OnesCount8(v))
+	}
+	return
+}
+
+// Last returns the number of blocks up to and including the last allocated one.
+func (b FreeBitmap) Last() int64 {
+	for i := len(b) - 1; i >= 0; i-- {
+		for j := 7; j >= 0; j-- {
+			if (b[i]>>j)&1 == 1 {
+				return int64(i*8 + j + 1)
+			}
+		}
+	}
+	return 0
+}
+
+// FreeBitmapCursor hands out free blocks of a FreeBitmap one by one.
+//
+// Deprecated: Package no longer allocates through it, blocks are allocated
+// in contiguous runs. It is kept for API compatibility.
 type FreeBitmapCursor struct {
 	src    FreeBitmap
 	cursor int
 }
 
+// Next marks the next free block as used and returns it, true means the
+// bitmap was grown for it.
+//
+// Deprecated: see FreeBitmapCursor.
 func (f *FreeBitmapCursor) Next() (uint32, bool) {
 	for {
 		idx := f.cursor / 8
@@ -0,0 +1,306 @@
+package vfs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// Files smaller than a block and tails of larger files are packed into shared
+// blocks made of slotsPerBlock slots. Shared blocks are marked as used in the
+// free bitmap while packedBucket keeps the mask of their used slots.
+const slotsPerBlock = 64
+
+// Extent is a piece of a shared block.
+type Extent struct {
+	Block uint32 `json:"b"`
+	Off   int64  `json:"o"`
+	Len   int64  `json:"l"`
+}
+
+func (e Extent) mask(slotSize int64) uint64 {
+	n := (e.Len + slotSize - 1) / slotSize
+	return (uint64(1)<<uint(n) - 1) << uint(e.Off/slotSize)
+}
+
+// space lists blocks and extents reserved by a writer or freed by a transaction.
+type space struct {
+	blocks  Blocks
+	extents []Extent
+}
+
+func (s space) empty() bool {
+	return len(s.blocks) == 0 && len(s.extents) == 0
+}
+
+// add adds the data of m to s.
+func (s *space) add(m Meta) {
+	s.blocks = append(s.blocks, m.Positions...)
+	if m.Tail != nil {
+		s.extents = append(s.extents, *m.Tail)
+	}
+}
+
+func (s *space) merge(o space) {
+	s.blocks = append(s.blocks, o.blocks...)
+	s.extents = append(s.extents, o.extents...)
+}
+
+// subtract removes the data of m from s.
+func (s *space) subtract(m Meta) {
+	s.blocks = subtractBlocks(s.blocks, m.Positions)
+	if m.Tail == nil {
+		return
+	}
+	res := s.extents[:0]
+	for _, e := range s.extents {
+		if e != *m.Tail {
+			res = append(res, e)
+		}
+	}
+	s.extents = res
+}
+
+// slots tracks used slots of shared blocks, which are indexed by their longest
+// run of free slots so writers can quickly find the best fitting one.
+type slots struct {
+	slotSize int64
+	masks    map[uint32]uint64
+	runs     [slotsPerBlock + 1]map[uint32]bool
+	draining map[uint32]bool // blocks compaction is emptying
+}
+
+// setMask sets the used slots of block b and returns mask, a zero mask means
+// b is not shared anymore.
+func (s *slots) setMask(b uint32, mask uint64) uint64 {
+	if old, ok := s.masks[b]; ok {
+		delete(s.runs[freeRun(old)], b)
+	}
+	if mask == 0 {
+		delete(s.masks, b)
+		return 0
+	}
+	if s.masks == nil {
+		s.masks = map[uint32]uint64{}
+	}
+	s.masks[b] = mask
+	r := freeRun(mask)
+	if s.runs[r] == nil {
+		s.runs[r] = map[uint32]bool{}
+	}
+	s.runs[r][b] = true
+	return mask
+}
+
+// freeRun returns the length of the longest run of free slots in mask.
+func freeRun(mask uint64) (longest int) {
+	n := 0
+	for i := 0; i < slotsPerBlock; i++ {
+		if mask&(1<<uint(i)) != 0 {
+			n = 0
+		} else if n++; n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
+
+// findRun returns the first slot of the first run of n free slots in mask.
+func findRun(mask uint64, n int) int {
+	run := 0
+	for i := 0; i < slotsPerBlock; i++ {
+		if mask&(1<<uint(i)) != 0 {
+			run = 0
+		} else if run++; run == n {
+			return i - n + 1
+		}
+	}
+	return -1
+}
+
+// reserveExtent reserves room for length bytes in the fullest shared block
+// which can hold them, or in a new shared block.
+func (a *allocator) reserveExtent(length int64) (Extent, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := int((length + a.slotSize - 1) / a.slotSize)
+	for r := n; r < slotsPerBlock; r++ {
+		for b := range a.runs[r] {
+			if a.draining[b] {
+				continue
+			}
+			e := Extent{Block: b, Off: int64(findRun(a.masks[b], n)) * a.slotSize, Len: length}
+			a.setMask(b, a.masks[b]|e.mask(a.slotSize))
+			return e, false
+		}
+	}
+	b := a.findFree(nil, 0, 1)
+	newBlock := a.take(b)
+	e := Extent{Block: b, Len: length}
+	a.setMask(b, e.mask(a.slotSize))
+	return e, newBlock
+}
+
+// drain stops packing into shared blocks selected by f and returns them.
+func (a *allocator) drain(f func(b uint32, mask uint64) bool) map[uint32]bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.draining = map[uint32]bool{}
+	for b, mask := range a.masks {
+		if f(b, mask) {
+			a.draining[b] = true
+		}
+	}
+	return a.draining
+}
+
+func (a *allocator) undrain() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.draining = nil
+}
+
+// updateSlots applies used and freed extents to the slot masks in the index,
+// shared blocks are marked in the free bitmap m as long as any slot is used.
+func updateSlots(tx *bbolt.Tx, slotSize int64, m *bitmapPages, use, free []Extent) error {
+	if len(use) == 0 && len(free) == 0 {
+		return nil
+	}
+	bk := tx.Bucket(packedBucket)
+	masks := map[uint32]uint64{}
+	get := func(b uint32) uint64 {
+		if v, ok := masks[b]; ok {
+			return v
+		}
+		if v := bk.Get(uint32ToBytes(b)); len(v) == 8 {
+			return binary.BigEndian.Uint64(v)
+		}
+		return 0
+	}
+	for _, e := range use {
+		masks[e.Block] = get(e.Block) | e.mask(slotSize)
+	}
+	for _, e := range free {
+		masks[e.Block] = get(e.Block) &^ e.mask(slotSize)
+	}
+	for b, v := range masks {
+		if v == 0 {
+			m.Free(b)
+			if err := bk.Delete(uint32ToBytes(b)); err != nil {
+				return err
+			}
+			continue
+		}
+		m.Set(b)
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, v)
+		if err := bk.Put(uint32ToBytes(b), buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSlots loads slot masks of shared blocks from the index.
+func (a *allocator) loadSlots(tx *bbolt.Tx) error {
+	return tx.Bucket(packedBucket).ForEach(func(k, v []byte) error {
+		if len(k) != 4 || len(v) != 8 {
+			return fmt.Errorf("load slots: invalid entry %x", k)
+		}
+		a.setMask(bytesToUint32(k), binary.BigEndian.Uint64(v))
+		return nil
+	})
+}
+
+// putTail writes buf into a newly reserved extent. The extent is returned even
+// on error so the caller can release it.
+func (p *Package) putTail(buf []byte) (Extent, error) {
+	e, newBlock := p.alloc.reserveExtent(int64(len(buf)))
+	off := e.Off
+	if newBlock {
+		// Pad new blocks so the store always ends at a block boundary
+		padded := make([]byte, p.blockSize)
+		copy(padded[off:], buf)
+		buf, off = padded, 0
+	}
+	if err := p.store.WriteBlock(e.Block, off, buf); err != nil {
+		return e, fmt.Errorf("write data: %v", err)
+	}
+	return e, nil
+}
+
+// packable tells whether n bytes at the end of a file go into a shared block.
+func (p *Package) packable(n int) bool {
+	slots := (int64(n) + p.alloc.slotSize - 1) / p.alloc.slotSize
+	return slots < slotsPerBlock
+}
+
+// compactTails moves tails out of drained shared blocks, so those blocks can
+// be freed.
+func (p *Package) compactTails(ctx context.Context, drained map[uint32]bool) error {
+	if len(drained) == 0 {
+		return nil
+	}
+
+	var moves []Meta
+	if err := p.ForEachMetaContext(ctx, "/", func(m Meta) error {
+		if m.Tail != nil && drained[m.Tail.Block] {
+			moves = append(moves, m)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, m := range moves {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.relocateTail(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relocateTail moves the tail of m into another extent, files changed in the
+// meantime are skipped.
+func (p *Package) relocateTail(m Meta) error {
+	buf := make([]byte, m.Tail.Len)
+	err := p.snapshot(func(tx *bbolt.Tx) error {
+		cur, err := p.infoTx(tx, m.Name)
+		if err != nil || cur.Tail == nil || *cur.Tail != *m.Tail {
+			return errRelocateConflict
+		}
+		if n, err := p.store.ReadBlock(m.Tail.Block, m.Tail.Off, buf); n != len(buf) {
+			return fmt.Errorf("relocate %q: %v", m.Name, err)
+		}
+		return nil
+	})
+	if err == errRelocateConflict {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	e, err := p.putTail(buf)
+	reserved := space{extents: []Extent{e}}
+	if err != nil {
+		p.alloc.release(reserved, p.trimData)
+		return err
+	}
+
+	err = p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
+		cur, err := p.infoTx(tx, m.Name)
+		if err != nil || cur.Generation != m.Generation || cur.Tail == nil || *cur.Tail != *m.Tail {
+			return errRelocateConflict
+		}
+		st.freed.extents = append(st.freed.extents, *cur.Tail)
+		cur.Tail = &e
+		return tx.Bucket(trunkBucket).Put([]byte(m.Name), cur.marshal())
+	})
+	if err == errRelocateConflict {
+		return nil
+	}
+	return err
+}
@@ -2,102 +2,325 @@ package vfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
 	bbolt "go.etcd.io/bbolt"
+	"golang.org/x/net/webdav"
 )
 
-var testFlagSimulateDataWriteError = 0
-
 type Package struct {
-	dbpath string
-	db     *bbolt.DB
-	data   *os.File
-	buffer []byte // can only be used in a locked environment
+	dbpath    string
+	tmpIndex  bool // index is removed on Close
+	db        *bbolt.DB
+	store     BlockStore
+	fs        fileSystem
+	alloc     allocator
+	notify    notifier
+	hooks     []Hook
+	hookError func(op *Operation, err error)
+	pool      sync.Pool // per-writer block buffers
+
+	blockSize      int64
+	smallThreshold int64
+	durability     Durability
+	syncs          syncGroup
+
+	davOnce  sync.Once
+	davLocks webdav.LockSystem // shared by all WebDAV handlers
+
+	closed chan struct{}
+}
+
+// OpenOptions configures a Package, it is optional when calling Open.
+type OpenOptions struct {
+	Hooks []Hook
+
+	// HookError is called with errors of After hooks run outside of
+	// transactions, they are logged by default.
+	HookError func(op *Operation, err error)
+
+	// Store holds data blocks instead of the default data file next to the
+	// index, it is closed with the Package. Its block size must be the one of
+	// the package.
+	Store BlockStore
+
+	// BlockSize and SmallThreshold are fixed when the package is created,
+	// BlockSize must be a multiple of 1 KiB and files smaller than
+	// SmallThreshold are stored in their meta. They default to the BlockSize
+	// and SmallBlockSize constants, when reopening they must be 0 or match.
+	BlockSize      int64
+	SmallThreshold int64
+
+	// SegmentSize splits the data of a new package into files of SegmentSize
+	// bytes named <data file>.0000, <data file>.0001 and so on. It must be a
+	// multiple of the block size and is fixed once the package is created,
+	// existing single file packages are not converted. Compact removes the
+	// segments past the last used block, DropSegment removes others once
+	// their blocks are free.
+	SegmentSize int64
+
+	// UploadTTL starts a janitor aborting multipart uploads which have not
+	// received any part for UploadTTL.
+	UploadTTL time.Duration
+
+	// PunchHoles releases the disk space of freed blocks right away, block
+	// numbers stay the same so the data file keeps its size. It needs a
+	// store supporting it, like data files on Linux.
+	PunchHoles bool
+
+	// Durability is DurabilityStrict by default.
+	Durability Durability
+
+	fs fileSystem // opens the index and data files, tests inject faults through it
 }
 
-func Open(path string) (*Package, error) {
+func Open(path string, opts ...OpenOptions) (*Package, error) {
 	path = strings.TrimSuffix(path, ".index")
-	db, err := bbolt.Open(path+".index", 0777, nil)
+	var o OpenOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.fs == nil {
+		o.fs = osFS{}
+	}
+	bo := *bbolt.DefaultOptions
+	bo.OpenFile = o.fs.OpenIndex
+	db, err := bbolt.Open(path+".index", 0777, &bo)
 	if err != nil {
 		return nil, err
 	}
+	return openDB(db, path, []OpenOptions{o})
+}
 
-	dataFileHash := ""
+// openDB opens a Package on top of an opened index, the data file is derived
+// from path unless a store is given.
+func openDB(db *bbolt.DB, path string, opts []OpenOptions) (*Package, error) {
+	var o OpenOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.BlockSize == 0 && o.Store != nil {
+		o.BlockSize = o.Store.BlockSize()
+	}
+	if o.BlockSize < 0 || o.BlockSize%1024 != 0 || o.SmallThreshold < 0 || o.SegmentSize < 0 {
+		db.Close()
+		return nil, fmt.Errorf("block size %d, small threshold %d, segment size %d: invalid", o.BlockSize, o.SmallThreshold, o.SegmentSize)
+	}
+
+	p := &Package{
+		db:     db,
+		dbpath: db.Path(),
+		closed: make(chan struct{}),
+	}
+	dataFileHash, segBlocks := "", int64(0)
 	if err := db.Update(func(tx *bbolt.Tx) error {
 		trunk, err := tx.CreateBucketIfNotExists(trunkBucket)
 		if err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists(changesBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(uploadsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(packedBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(freeBucket); err != nil {
+			return err
+		}
+		if err := migrateBitmap(tx); err != nil {
+			return err
+		}
 		h := trunk.Get(dataFileKey)
-		if len(h) != 8 {
+		created := len(h) != 8
+		if created {
 			h = random(8)
 		}
 		dataFileHash = hex.EncodeToString(h)
+
+		// fixed returns the value of option key, which is want or def when the
+		// package is created, and def for packages predating the option.
+		fixed := func(key []byte, name string, want, def int64) (v int64, err error) {
+			if v = bytesToInt64(trunk.Get(key)); v == 0 {
+				if v = def; created && want > 0 {
+					v = want
+				}
+				if v > 0 {
+					err = trunk.Put(key, int64ToBytes(v))
+				}
+			}
+			if err == nil && want > 0 && want != v {
+				err = fmt.Errorf("%s %d: package uses %d", name, want, v)
+			}
+			return v, err
+		}
+		if p.blockSize, err = fixed(blockSizeKey, "block size", o.BlockSize, BlockSize); err != nil {
+			return err
+		}
+		if p.smallThreshold, err = fixed(smallThresholdKey, "small threshold", o.SmallThreshold, SmallBlockSize); err != nil {
+			return err
+		}
+		// Segmentation is chosen when the package is created
+		if o.Store != nil {
+			o.SegmentSize = 0
+		} else if o.SegmentSize%p.blockSize != 0 {
+			return fmt.Errorf("segment size %d: not a multiple of block size", o.SegmentSize)
+		}
+		segSize, err := fixed(segmentSizeKey, "segment size", o.SegmentSize, 0)
+		if err != nil && !created && segSize == 0 {
+			err = nil // single file packages stay single file
+		}
+		if err != nil {
+			return err
+		}
+		segBlocks = segSize / p.blockSize
 		return trunk.Put(dataFileKey, h)
 	}); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	f, err := os.OpenFile(path+"."+dataFileHash+".data", os.O_CREATE|os.O_RDWR, 0777)
-	if err != nil {
+	p.hooks, p.store, p.durability, p.fs = o.Hooks, o.Store, o.Durability, o.fs
+	if p.fs == nil {
+		p.fs = osFS{}
+	}
+	if p.hookError = o.HookError; p.hookError == nil {
+		p.hookError = logHookError
+	}
+	if p.store == nil {
+		var err error
+		if p.store, err = openDataStore(p.fs, path+"."+dataFileHash+".data", p.blockSize, segBlocks); err != nil {
+			db.Close()
+			return nil, err
+		}
+	} else if p.store.BlockSize() != p.blockSize {
+		db.Close()
+		return nil, fmt.Errorf("block size %d: package uses %d", p.store.BlockSize(), p.blockSize)
+	}
+	if o.PunchHoles {
+		h, ok := p.store.(holePuncher)
+		if !ok {
+			p.Close()
+			return nil, ErrPunchUnsupported
+		}
+		p.alloc.punch = h.PunchHole
+	}
+	p.pool.New = func() interface{} { return make([]byte, p.blockSize) }
+	p.alloc.slotSize = p.blockSize / slotsPerBlock
+	if err := db.View(func(tx *bbolt.Tx) error {
+		p.alloc.load(loadBitmap(tx))
+		return p.alloc.loadSlots(tx)
+	}); err != nil {
+		p.Close()
 		return nil, err
 	}
-
-	p := &Package{
-		db:     db,
-		dbpath: path + ".index",
-		data:   f,
-		buffer: make([]byte, BlockSize),
+	// Segments may have been archived or removed, none of them must hold data
+	if s, ok := p.store.(*segmentStore); ok {
+		if err := s.checkGaps(p.alloc.isUsed, p.alloc.used.Last()); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	// Uploads interrupted by a crash may have left uncommitted blocks at the end of the data file
+	p.alloc.release(space{}, p.trimData)
+	if o.UploadTTL > 0 {
+		go p.uploadJanitor(o.UploadTTL)
 	}
 	return p, nil
 }
 
 func (p *Package) Close() error {
-	if err1, err2 := p.db.Close(), p.data.Close(); err1 != nil || err2 != nil {
+	defer p.notify.broadcast() // wake up watchers so they can quit
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	err1, err2 := p.db.Close(), p.store.Close()
+	if p.tmpIndex {
+		os.Remove(p.db.Path())
+	}
+	if err1 != nil || err2 != nil {
 		return fmt.Errorf("close package: %v or %v", err1, err2)
 	}
 	return nil
 }
 
-func (p *Package) putData(tx *bbolt.Tx, buf []byte, c *FreeBitmapCursor) (int64, error) {
-	assert(len(buf) <= BlockSize)
-
-	boff, newBlock := c.Next()
-	off := int64(boff) * BlockSize
-	if _, err := p.data.Seek(off, 0); err != nil {
-		return 0, err
+// putData writes buf into a newly reserved block. The block is returned even
+// on error so the caller can release it.
+func (p *Package) putData(buf []byte, c *claim) (uint32, error) {
+	assert(int64(len(buf)) <= p.blockSize)
+
+	boff, newBlock := p.alloc.reserve(c)
+	if newBlock && int64(len(buf)) < p.blockSize {
+		// Pad new blocks so the store always ends at a block boundary
+		padded := make([]byte, p.blockSize)
+		copy(padded, buf)
+		buf = padded
 	}
-
-	if testFlagSimulateDataWriteError > 0 && rand.Intn(testFlagSimulateDataWriteError) == 0 {
-		x := buf[:rand.Intn(len(buf))]
-		fmt.Println("test flag: simulate data write error, off=", off, "size=", len(buf), "write=", len(x))
-		p.data.Write(x)
-		return 0, fmt.Errorf("testable")
+	if err := p.store.WriteBlock(boff, 0, buf); err != nil {
+		return boff, fmt.Errorf("write data: %v", err)
 	}
+	return boff, nil
+}
 
-	n, err := p.data.Write(buf)
-	if err != nil || n != len(buf) {
-		return 0, fmt.Errorf("write data: %v, written: %v", err, n)
-	}
+// trimData cuts the store after its last used block, dropping blocks written
+// by failed uploads. It must be called through allocator.release.
+func (p *Package) trimData(blocks int64) {
+	p.store.Truncate(blocks)
+}
+
+// txState collects what a write transaction leaves to be done after it commits.
+type txState struct {
+	freed space        // space to be handed back to the allocator
+	ops   []*Operation // operations to be passed to hooks running outside of the transaction
+}
 
-	if newBlock && n < BlockSize {
-		paddings := make([]byte, BlockSize-n)
-		n, err = p.data.Write(paddings)
-		if err != nil || n != len(paddings) {
-			return 0, fmt.Errorf("write paddings: %v, written: %v", err, n)
+// update runs f in a write transaction. Space reserved by the caller is
+// marked as used on commit, or released if anything fails.
+func (p *Package) update(reserved space, f func(tx *bbolt.Tx, st *txState) error) error {
+	if !reserved.empty() {
+		if err := p.syncData(); err != nil {
+			p.alloc.release(reserved, p.trimData)
+			return err
 		}
 	}
-	return off, nil
+	st := &txState{}
+	if err := p.db.Update(func(tx *bbolt.Tx) error {
+		if err := f(tx, st); err != nil {
+			return err
+		}
+		return updateFreeBitmap(tx, p.alloc.slotSize, reserved, st.freed)
+	}); err != nil {
+		p.alloc.release(reserved, p.trimData)
+		return err
+	}
+	p.alloc.free(st.freed)
+	p.notify.broadcast()
+	for _, op := range st.ops {
+		p.committed(op)
+	}
+	return nil
+}
+
+// snapshot runs f in a read transaction, data blocks of the metas seen by f
+// are not reused until it returns, so files can be read consistently.
+func (p *Package) snapshot(f func(tx *bbolt.Tx) error) error {
+	p.alloc.pin()
+	defer p.alloc.unpin()
+	return p.db.View(f)
 }
 
 func (p *Package) ReadAll(key string) ([]byte, error) {
@@ -110,289 +333,607 @@ func (p *Package) ReadAll(key string) ([]byte, error) {
 }
 
 func (p *Package) Info(key string) (m Meta, err error) {
-	if !checkName(key) {
-		return m, ErrInvalidName
-	}
-	keybuf := []byte(key)
 	err = p.db.View(func(tx *bbolt.Tx) error {
-		bk := tx.Bucket(trunkBucket)
-		metabuf := bk.Get(keybuf)
-		if len(metabuf) == 0 {
-			count := bytesToInt64(bk.Get([]byte(string(totalCountKey) + key)))
-			if count > 0 {
-				// Is a top level directory
-				size := bytesToInt64(bk.Get([]byte(string(totalSizeKey) + key)))
-				m = Meta{Name: key + "/", IsDir: true, Size: size, Count: count}
-				return nil
-			}
-			dirbuf := []byte(key + "/")
-			k, _ := bk.Cursor().Seek(dirbuf)
-			if bytes.HasPrefix(k, dirbuf) {
-				m = Meta{Name: key + "/", IsDir: true}
-				return nil
-			}
-			return ErrNotFound
-		}
-		m = unmarshalMeta(metabuf)
-		return nil
+		var err error
+		m, err = p.infoTx(tx, key)
+		return err
 	})
 	return m, err
 }
 
+func (p *Package) infoTx(tx *bbolt.Tx, key string) (m Meta, err error) {
+	if !checkName(key) {
+		return m, ErrInvalidName
+	}
+	bk := tx.Bucket(trunkBucket)
+	metabuf := bk.Get([]byte(key))
+	if len(metabuf) == 0 {
+		count := bytesToInt64(bk.Get([]byte(string(totalCountKey) + key)))
+		if count > 0 {
+			// Is a top level directory
+			size := bytesToInt64(bk.Get([]byte(string(totalSizeKey) + key)))
+			return Meta{Name: key + "/", IsDir: true, Size: size, Count: count}, nil
+		}
+		if isDir(bk, key) {
+			return Meta{Name: key + "/", IsDir: true}, nil
+		}
+		return m, ErrNotFound
+	}
+	return unmarshalMeta(metabuf, p.blockSize)
+}
+
+func isDir(bk *bbolt.Bucket, key string) bool {
+	dirbuf := []byte(key + "/")
+	k, _ := bk.Cursor().Seek(dirbuf)
+	return bytes.HasPrefix(k, dirbuf)
+}
+
 func (p *Package) Open(key string) (*File, error) {
+	f, _, err := p.open(key)
+	return f, err
+}
+
+// open opens key and returns its meta too.
+func (p *Package) open(key string) (*File, Meta, error) {
+	op := &Operation{Op: OpOpen, Name: key}
+	if err := p.before(false, op); err != nil {
+		return nil, Meta{}, err
+	}
 	m, err := p.Info(key)
 	if err != nil {
-		return nil, err
+		return nil, m, err
 	}
 	if m.IsDir {
-		return nil, ErrIsDirectory
+		return nil, m, ErrIsDirectory
 	}
+	op.Meta = &m
+	p.committed(op)
+	f, err := p.openMeta(m)
+	return f, m, err
+}
 
+func (p *Package) openMeta(m Meta) (*File, error) {
 	if len(m.SmallData) == int(m.Size) {
 		return &File{size: int64(len(m.SmallData)), small: m.SmallData}, nil
 	}
 
-	f, err := os.OpenFile(p.data.Name(), os.O_RDONLY, 0777)
-	if err != nil {
-		return nil, err
-	}
-
-	r := &File{f: f, size: m.Size, offsets: make([]int64, 0, len(m.Positions)/2)}
-	m.Positions.ForEach(func(v uint32) error {
-		r.offsets = append(r.offsets, int64(v)*BlockSize)
+	r := &File{store: p.store, blockSize: p.blockSize, size: m.Size, tail: m.Tail}
+	m.Positions.ForEachRun(func(start, n uint32) error {
+		r.runs = append(r.runs, blockRun{r.nblocks, start, n})
+		r.nblocks += int64(n)
 		return nil
 	})
 	return r, nil
 }
 
-func (p *Package) UpdateTags(key string, f func(map[string]string) error) error {
-	return p.db.Update(func(tx *bbolt.Tx) error {
-		m, err := p.Info(key)
-		if err != nil {
-			return err
-		}
-		if m.IsDir {
-			return ErrIsDirectory
-		}
-		if m.Tags == nil {
-			m.Tags = map[string]string{}
-		}
-		if err := f(m.Tags); err != nil {
+// newOp creates an operation and runs hooks outside of transactions on it.
+func (p *Package) newOp(o Op, name, oldName string) (*Operation, error) {
+	op := &Operation{Op: o, Name: name, OldName: oldName}
+	return op, p.before(false, op)
+}
+
+// finish logs the change of op and runs hooks after it. m is the meta stored
+// by op, nil if op removed the key.
+func (p *Package) finish(tx *bbolt.Tx, st *txState, op *Operation, m *Meta) error {
+	if m == nil {
+		if err := logChange(tx, op.Op, op.OldName, Meta{Name: op.Name}); err != nil {
 			return err
 		}
-		return tx.Bucket(trunkBucket).Put([]byte(key), m.marshal())
+	} else if err := logChange(tx, op.Op, op.OldName, *m); err != nil {
+		return err
+	}
+	op.Meta = m
+	if err := p.after(true, op); err != nil {
+		return err
+	}
+	st.ops = append(st.ops, op)
+	return nil
+}
+
+func (p *Package) UpdateTags(key string, f func(map[string]string) error) error {
+	op, err := p.newOp(OpUpdateTags, key, "")
+	if err != nil {
+		return err
+	}
+	return p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return p.updateTagsTx(tx, st, op, f, nil)
 	})
 }
 
+func (p *Package) updateTagsTx(tx *bbolt.Tx, st *txState, op *Operation, f func(map[string]string) error, conds []Precondition) error {
+	m, err := p.infoTx(tx, op.Name)
+	if err != nil {
+		return err
+	}
+	if m.IsDir {
+		return ErrIsDirectory
+	}
+	if err := checkPreconditions(&m, conds); err != nil {
+		return err
+	}
+	if m.Generation, err = nextGeneration(tx); err != nil {
+		return err
+	}
+	tags := map[string]string{}
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	if err := f(tags); err != nil {
+		return err
+	}
+	cur := m
+	op.Meta, op.Tags = &cur, tags
+	if err := p.before(true, op); err != nil {
+		return err
+	}
+	m.Tags = op.Tags
+	if err := tx.Bucket(trunkBucket).Put([]byte(m.Name), m.marshal()); err != nil {
+		return err
+	}
+	return p.finish(tx, st, op, &m)
+}
+
 func (p *Package) WriteAll(key string, value []byte, kvs ...string) error {
 	return p.Write(key, bytes.NewReader(value), kvs...)
 }
 
+// Write stores value under key. Data blocks are written outside of the index
+// transaction, so concurrent writers only serialize on committing their metas.
 func (p *Package) Write(key string, value io.Reader, kvs ...string) error {
+	return p.WriteContext(context.Background(), key, value, kvs...)
+}
+
+// WriteContext is Write which stops copying value once ctx is done, in that
+// case nothing is committed and ctx.Err() is returned.
+func (p *Package) WriteContext(ctx context.Context, key string, value io.Reader, kvs ...string) error {
+	op, reserved, err := p.prepareWrite(ctx, key, value, kvs)
+	if err != nil {
+		return err
+	}
+	return p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
+		return p.writeTx(tx, st, op, nil)
+	})
+}
+
+// prepareWrite uploads value into reserved space and returns the operation
+// to be committed by writeTx.
+func (p *Package) prepareWrite(ctx context.Context, key string, value io.Reader, kvs []string) (*Operation, space, error) {
 	if !checkName(key) {
-		return ErrInvalidName
+		return nil, space{}, ErrInvalidName
 	}
 	if len(kvs)%2 == 1 {
-		return fmt.Errorf("write: invalid key value pairs")
+		return nil, space{}, fmt.Errorf("write: invalid key value pairs")
 	}
-	keybuf := []byte(key)
-	return p.db.Update(func(tx *bbolt.Tx) (E error) {
-		bk := tx.Bucket(trunkBucket)
-		metabuf := bk.Get(keybuf)
-		m := Meta{
-			Name:       key,
-			CreateTime: time.Now().Unix(),
-			ModTime:    time.Now().Unix(),
-			Tags:       kvsToMap(kvs...),
-		}
-
-		if len(metabuf) > 0 {
-			// Overwrite existing data
-			old := unmarshalMeta(metabuf)
-			m.CreateTime = old.CreateTime
-			if err := p.incTotalSize(tx, key, -old.Size, -1); err != nil {
-				return err
-			}
-			defer func() {
-				if E == nil {
-					E = old.Positions.Free(tx)
-				}
-			}()
-			// Write data to new blocks, then recycle old blocks in the above defer-call
-		} else {
-			// Check name collision between file and dir, e.g.: "/a/" and "/a"
-			dirbuf := []byte(key + "/")
-			k, _ := bk.Cursor().Seek(dirbuf)
-			if bytes.HasPrefix(k, dirbuf) {
-				return fmt.Errorf("write: directory name collision")
-			}
+	// Fail early before uploading anything, the check is repeated when committing
+	if err := p.db.View(func(tx *bbolt.Tx) error {
+		if isDir(tx.Bucket(trunkBucket), key) {
+			return fmt.Errorf("write: directory name collision")
 		}
+		return nil
+	}); err != nil {
+		return nil, space{}, err
+	}
 
-		small := bytes.Buffer{}
-		beforeEOF, err := p.data.Seek(0, 2)
-		if err != nil {
-			return err
-		}
+	head, rest, err := p.readHead(value)
+	if err != nil {
+		return nil, space{}, err
+	}
+	op := &Operation{Op: OpWrite, Name: key, Tags: kvsToMap(kvs...), Head: head}
+	if err := p.before(false, op); err != nil {
+		return nil, space{}, err
+	}
 
-		defer func() {
-			if E != nil {
-				// If encountered error, data file may be appended with unwanted bytes already
-				p.data.Truncate(beforeEOF)
-			}
-		}()
+	op.m = Meta{
+		Name:       key,
+		CreateTime: time.Now().Unix(),
+		ModTime:    time.Now().Unix(),
+	}
+	reserved, err := p.copyData(ctx, &op.m, head, rest)
+	return op, reserved, err
+}
 
-		m.Crc32, err = p.ioCopy(tx, &m, value, func(data []byte) {
-			if small.Len() < SmallBlockSize {
-				small.Write(data)
-			}
-		})
+func (p *Package) writeTx(tx *bbolt.Tx, st *txState, op *Operation, conds []Precondition) error {
+	bk := tx.Bucket(trunkBucket)
+	m := op.m
+	var old *Meta
+	if metabuf := bk.Get([]byte(m.Name)); len(metabuf) > 0 {
+		cur, err := unmarshalMeta(metabuf, p.blockSize)
 		if err != nil {
 			return err
 		}
+		old = &cur
+	} else if isDir(bk, m.Name) {
+		// Check name collision between file and dir, e.g.: "/a/" and "/a"
+		return fmt.Errorf("write: directory name collision")
+	}
+	if err := checkPreconditions(old, conds); err != nil {
+		return err
+	}
+	op.Meta = old
+	if err := p.before(true, op); err != nil {
+		return err
+	}
+	m.Tags = op.Tags
 
-		if m.Size < SmallBlockSize {
-			// Store small data outside data file to reduce fragments
-			if err := m.Positions.Free(tx); err != nil {
-				return err
-			}
-			m.SmallData = small.Bytes()
-			m.Positions = nil
-		}
-
-		if err := p.incTotalSize(tx, key, m.Size, 1); err != nil {
+	if old != nil {
+		// Overwrite existing data, old blocks are recycled after committing
+		m.CreateTime = old.CreateTime
+		if err := p.incTotalSize(tx, m.Name, -old.Size, -1); err != nil {
 			return err
 		}
+		st.freed.add(*old)
+	}
+	var err error
+	if m.Generation, err = nextGeneration(tx); err != nil {
+		return err
+	}
+	if err := p.incTotalSize(tx, m.Name, m.Size, 1); err != nil {
+		return err
+	}
+	if err := bk.Put([]byte(m.Name), m.marshal()); err != nil {
+		return err
+	}
+	return p.finish(tx, st, op, &m)
+}
 
-		// fmt.Println(m.Name, len(m.Positions))
-		return bk.Put(keybuf, m.marshal())
+// writeWithModTime is Write keeping the mod time of imported data.
+func (p *Package) writeWithModTime(ctx context.Context, key string, value io.Reader, modTime int64, kvs []string) error {
+	op, reserved, err := p.prepareWrite(ctx, key, value, kvs)
+	if err != nil {
+		return err
+	}
+	op.m.ModTime = modTime
+	return p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
+		return p.writeTx(tx, st, op, nil)
 	})
 }
 
-func (p *Package) ioCopy(tx *bbolt.Tx, m *Meta, src io.Reader, onRead func([]byte)) (uint32, error) {
+// readHead reads the first smallThreshold bytes of r, rest is nil if r has
+// nothing more.
+func (p *Package) readHead(r io.Reader) (head []byte, rest io.Reader, err error) {
+	if r == nil {
+		return nil, nil, nil
+	}
+	head = make([]byte, p.smallThreshold)
+	n, err := io.ReadFull(r, head)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return head[:n], nil, nil
+	case nil:
+		return head, r, nil
+	}
+	return nil, nil, err
+}
+
+// copyData stores head followed by rest into m, data smaller than
+// smallThreshold is kept in the meta itself to reduce fragments.
+func (p *Package) copyData(ctx context.Context, m *Meta, head []byte, rest io.Reader) (space, error) {
+	if rest == nil && int64(len(head)) < p.smallThreshold {
+		m.Size = int64(len(head))
+		m.SmallData = head
+		m.Crc32 = crc32.ChecksumIEEE(head)
+		return space{}, nil
+	}
+	size := int64(-1)
+	if n := remaining(rest); n >= 0 {
+		size = int64(len(head)) + n
+	}
+	return p.ioCopy(ctx, m, io.MultiReader(bytes.NewReader(head), rest), p.newClaim(size))
+}
+
+// remaining returns the number of bytes left in r, or -1 if unknown.
+func remaining(r io.Reader) int64 {
+	switch r := r.(type) {
+	case nil:
+		return 0
+	case interface{ Len() int }:
+		return int64(r.Len())
+	}
+	return -1
+}
+
+// ioCopy writes src into blocks of claim c appended to m.Positions, the last
+// partial block goes into m.Tail if it can be packed. It returns the
+// reserved space, on error, including ctx being done, all of it has been
+// released already.
+func (p *Package) ioCopy(ctx context.Context, m *Meta, src io.Reader, c *claim) (reserved space, err error) {
 	h := crc32.NewIEEE()
 
 	// equals: h.(*crc32.digest).crc = m.Crc32
 	*(*uint32)((*(*[2]unsafe.Pointer)(unsafe.Pointer(&h)))[1]) = m.Crc32
 	if src == nil {
-		return h.Sum32(), nil
+		return reserved, nil
 	}
 
-	c := &FreeBitmapCursor{src: FreeBitmap(append([]byte{}, tx.Bucket(trunkBucket).Get(freeKey)...))}
+	defer func() {
+		p.alloc.unclaim(c)
+		if err != nil {
+			p.alloc.release(reserved, p.trimData)
+		}
+	}()
+
+	buf := p.pool.Get().([]byte)
+	defer p.pool.Put(buf)
+
 	for {
-		n, err := src.Read(p.buffer)
-		if n > 0 {
+		if err := ctx.Err(); err != nil {
+			return reserved, err
+		}
+		n, err := io.ReadFull(src, buf)
+		if n > 0 && n < len(buf) && p.packable(n) {
+			e, err := p.putTail(buf[:n])
+			reserved.extents = append(reserved.extents, e)
+			if err != nil {
+				return reserved, err
+			}
 			m.Size += int64(n)
-			h.Write(p.buffer[:n])
-			onRead(p.buffer[:n])
-			bp, err := p.putData(tx, p.buffer[:n], c)
+			h.Write(buf[:n])
+			m.Tail = &e
+		} else if n > 0 {
+			bp, err := p.putData(buf[:n], c)
+			reserved.blocks.Append(bp)
 			if err != nil {
-				return 0, err
+				return reserved, err
 			}
-			m.Positions.Append(uint32(bp / BlockSize))
+			m.Size += int64(n)
+			h.Write(buf[:n])
+			m.Positions.Append(bp)
 		}
-		if n == 0 || err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
 		}
 		if err != nil {
-			return 0, err
+			return reserved, err
 		}
 	}
-	if err := tx.Bucket(trunkBucket).Put(freeKey, c.src); err != nil {
-		return 0, err
-	}
-	return h.Sum32(), nil
+	m.Crc32 = h.Sum32()
+	return reserved, nil
 }
 
 func (p *Package) Append(key string, value io.Reader) error {
-	return p.db.Update(func(tx *bbolt.Tx) (E error) {
+	return p.appendIf(context.Background(), key, value, nil)
+}
+
+// AppendContext is Append which stops copying value once ctx is done, in that
+// case nothing is committed and ctx.Err() is returned.
+func (p *Package) AppendContext(ctx context.Context, key string, value io.Reader) error {
+	return p.appendIf(ctx, key, value, nil)
+}
+
+func (p *Package) appendIf(ctx context.Context, key string, value io.Reader, conds []Precondition) error {
+	op, err := p.newOp(OpAppend, key, "")
+	if err != nil {
+		return err
+	}
+	m, err := p.Info(key)
+	if err != nil {
+		return err
+	}
+	if m.IsDir {
+		return ErrIsDirectory
+	}
+	// The commit below fails if m changes in between, so checking once is enough
+	if err := checkPreconditions(&m, conds); err != nil {
+		return err
+	}
+	if len(m.SmallData) == int(m.Size) {
+		return fmt.Errorf("append: small data not supported")
+	}
+	if m.Size%p.blockSize != 0 {
+		return fmt.Errorf("append: data not aligned")
+	}
+
+	base, oldSize := m.marshal(), m.Size
+	reserved, err := p.ioCopy(ctx, &m, value, p.newClaim(remaining(value)))
+	if err != nil {
+		return err
+	}
+	m.ModTime = time.Now().Unix()
+
+	return p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
 		bk := tx.Bucket(trunkBucket)
-		m, err := p.Info(key)
-		if err != nil {
-			return err
-		}
-		if m.IsDir {
-			return ErrIsDirectory
+		cur, err := unmarshalMeta(bk.Get([]byte(key)), p.blockSize)
+		if err != nil || !bytes.Equal(cur.marshal(), base) {
+			return fmt.Errorf("append: %q modified concurrently", key)
 		}
-		if len(m.SmallData) == int(m.Size) {
-			return fmt.Errorf("append: small data not supported")
-		}
-		if m.Size%BlockSize != 0 {
-			return fmt.Errorf("append: data not aligned")
-		}
-
-		beforeEOF, err := p.data.Seek(0, 2)
-		if err != nil {
+		op.Meta = &cur
+		if err := p.before(true, op); err != nil {
 			return err
 		}
-		defer func() {
-			if E != nil {
-				// If encountered error, data file may be appended with unwanted bytes already
-				p.data.Truncate(beforeEOF)
-			}
-		}()
-
-		oldSize := m.Size
-		m.Crc32, err = p.ioCopy(tx, &m, value, func([]byte) {})
-		if err != nil {
+		if m.Generation, err = nextGeneration(tx); err != nil {
 			return err
 		}
-
 		if err := p.incTotalSize(tx, key, m.Size-oldSize, 0); err != nil {
 			return err
 		}
-		return bk.Put([]byte(key), m.marshal())
+		if err := bk.Put([]byte(key), m.marshal()); err != nil {
+			return err
+		}
+		return p.finish(tx, st, op, &m)
 	})
 }
 
+// Delete removes a file, or a directory created by Mkdir if it is empty.
 func (p *Package) Delete(key string) error {
-	return p.db.Update(func(tx *bbolt.Tx) error {
-		m, err := p.Info(key)
-		if err != nil {
-			return err
-		}
-		if m.IsDir {
-			return ErrIsDirectory
-		}
-		if err := m.Positions.Free(tx); err != nil {
-			return err
-		}
-		if err := p.incTotalSize(tx, key, -m.Size, -1); err != nil {
-			return err
-		}
-		return tx.Bucket(trunkBucket).Delete([]byte(key))
+	op, err := p.newOp(OpDelete, key, "")
+	if err != nil {
+		return err
+	}
+	return p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return p.deleteTx(tx, st, op, nil)
 	})
 }
 
+func (p *Package) deleteTx(tx *bbolt.Tx, st *txState, op *Operation, conds []Precondition) error {
+	bk := tx.Bucket(trunkBucket)
+	m, err := p.infoTx(tx, op.Name)
+	if err != nil {
+		return err
+	}
+	op.Meta = &m
+	if m.IsDir {
+		c := bk.Cursor()
+		if k, _ := c.Seek([]byte(m.Name)); string(k) == m.Name {
+			if k, _ := c.Next(); !bytes.HasPrefix(k, []byte(m.Name)) {
+				if err := p.before(true, op); err != nil {
+					return err
+				}
+				if err := bk.Delete([]byte(m.Name)); err != nil {
+					return err
+				}
+				return p.finish(tx, st, op, nil)
+			}
+		}
+		return ErrIsDirectory
+	}
+	if err := checkPreconditions(&m, conds); err != nil {
+		return err
+	}
+	if err := p.before(true, op); err != nil {
+		return err
+	}
+	st.freed.add(m)
+	if err := p.incTotalSize(tx, m.Name, -m.Size, -1); err != nil {
+		return err
+	}
+	if err := bk.Delete([]byte(m.Name)); err != nil {
+		return err
+	}
+	return p.finish(tx, st, op, nil)
+}
+
+// Copy copies data and tags of src to dst. Blocks of src stay pinned from
+// reading its meta until the copy is done, as in a snapshot, so data and tags
+// come from the same version. No read transaction is held, writing dst needs
+// to commit.
+func (p *Package) Copy(src, dst string, overwrite bool) error {
+	p.alloc.pin()
+	defer p.alloc.unpin()
+	r, m, err := p.open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if !overwrite {
+		return p.If(IfNotExists()).Write(dst, r, tagsToKVs(m.Tags)...)
+	}
+	return p.Write(dst, r, tagsToKVs(m.Tags)...)
+}
+
 func (p *Package) Move(oldname, newname string, overwrite bool) error {
-	return p.db.Update(func(tx *bbolt.Tx) error {
-		bk := tx.Bucket(trunkBucket)
-		old, err := p.Info(oldname)
+	op, err := p.newOp(OpMove, newname, oldname)
+	if err != nil {
+		return err
+	}
+	return p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return p.moveTx(tx, st, op, overwrite, nil)
+	})
+}
+
+func (p *Package) moveTx(tx *bbolt.Tx, st *txState, op *Operation, overwrite bool, conds []Precondition) error {
+	bk := tx.Bucket(trunkBucket)
+	oldname, newname := op.OldName, op.Name
+	old, err := p.infoTx(tx, oldname)
+	if err != nil {
+		return err
+	}
+	if old.IsDir {
+		return ErrIsDirectory
+	}
+	if err := checkPreconditions(&old, conds); err != nil {
+		return err
+	}
+	if oldname == newname {
+		return nil
+	}
+	if !checkName(newname) {
+		return ErrInvalidName
+	}
+	cur := old
+	op.Meta = &cur
+	if err := p.before(true, op); err != nil {
+		return err
+	}
+	if new, err := p.infoTx(tx, newname); err != ErrNotFound {
 		if err != nil {
-			return err
+			return fmt.Errorf("rename: %v", err)
 		}
-		if old.IsDir {
+		if new.IsDir {
 			return ErrIsDirectory
 		}
-		if new, err := p.Info(newname); err != ErrNotFound {
-			if err != nil {
-				return fmt.Errorf("rename: %v", err)
-			}
-			if !overwrite {
-				return fmt.Errorf("rename: new name existed")
-			}
-			if err := new.Positions.Free(tx); err != nil {
-				return err
-			}
+		if !overwrite {
+			return fmt.Errorf("rename: new name existed")
 		}
-
-		old.Name = newname
-		if err := bk.Delete([]byte(oldname)); err != nil {
+		st.freed.add(new)
+		if err := p.incTotalSize(tx, newname, -new.Size, -1); err != nil {
 			return err
 		}
-		return bk.Put([]byte(newname), old.marshal())
+	}
+
+	if err := p.incTotalSize(tx, oldname, -old.Size, -1); err != nil {
+		return err
+	}
+	if err := p.incTotalSize(tx, newname, old.Size, 1); err != nil {
+		return err
+	}
+	old.Name = newname
+	if old.Generation, err = nextGeneration(tx); err != nil {
+		return err
+	}
+	if err := bk.Delete([]byte(oldname)); err != nil {
+		return err
+	}
+	if err := bk.Put([]byte(newname), old.marshal()); err != nil {
+		return err
+	}
+	return p.finish(tx, st, op, &old)
+}
+
+// Mkdir creates an empty directory, which is stored as a key ending with "/".
+// Directories are otherwise implied by the names of the files inside them.
+func (p *Package) Mkdir(key string) error {
+	op, err := p.newOp(OpMkdir, key, "")
+	if err != nil {
+		return err
+	}
+	return p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return p.mkdirTx(tx, st, op)
 	})
 }
 
+func (p *Package) mkdirTx(tx *bbolt.Tx, st *txState, op *Operation) error {
+	m, err := p.infoTx(tx, op.Name)
+	if err == nil {
+		if m.IsDir {
+			return nil
+		}
+		return fmt.Errorf("mkdir: file name collision")
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	if err := p.before(true, op); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	m = Meta{Name: op.Name + "/", CreateTime: now, ModTime: now, IsDir: true}
+	if m.Generation, err = nextGeneration(tx); err != nil {
+		return err
+	}
+	if err := tx.Bucket(trunkBucket).Put([]byte(m.Name), m.marshal()); err != nil {
+		return err
+	}
+	return p.finish(tx, st, op, &m)
+}
+
+// nextGeneration returns a number greater than any generation handed out
+// before, every committed change of a meta is stamped with one.
+func nextGeneration(tx *bbolt.Tx) (int64, error) {
+	bk := tx.Bucket(trunkBucket)
+	gen := bytesToInt64(bk.Get(generationKey)) + 1
+	return gen, bk.Put(generationKey, int64ToBytes(gen))
+}
+
 func (p *Package) incTotalSize(tx *bbolt.Tx, name string, sz, cnt int64) error {
 	bk := tx.Bucket(trunkBucket)
 
@@ -421,12 +962,20 @@ func (p *Package) incTotalSize(tx *bbolt.Tx, name string, sz, cnt int64) error {
 func (p *Package) Stat() (s struct {
 	Size        int64 // Size of all stored files
 	DiskSize    int64 // Actual disk size (index + data)
+	DataSize    int64 // Apparent size of the data file
+	DataAlloc   int64 // Disk space used by the data file, less than DataSize if it has holes
 	Files       int64 // Total number of files
 	AllocBlocks int64 // Total allocated blocks
+	BlockSize   int64
 	DataFile    string
 	IndexFile   string
 }) {
-	s.DiskSize, _ = p.data.Seek(0, 2)
+	s.DataSize, _ = p.store.Size()
+	s.DataAlloc = s.DataSize
+	if st, ok := p.store.(interface{ AllocatedSize() (int64, error) }); ok {
+		s.DataAlloc, _ = st.AllocatedSize()
+	}
+	s.DiskSize = s.DataSize
 	if fi, _ := os.Stat(p.dbpath); fi != nil {
 		s.DiskSize += fi.Size()
 	}
@@ -434,10 +983,13 @@ func (p *Package) Stat() (s struct {
 		bk := tx.Bucket(trunkBucket)
 		s.Size = bytesToInt64(bk.Get(totalSizeKey))
 		s.Files = bytesToInt64(bk.Get(totalCountKey))
-		s.AllocBlocks = int64(len(bk.Get(freeKey)) * 8)
+		s.AllocBlocks = int64(len(loadBitmap(tx)) * 8)
 		return nil
 	})
-	s.DataFile = p.data.Name()
+	if st, ok := p.store.(interface{ Path() string }); ok {
+		s.DataFile = st.Path()
+	}
 	s.IndexFile = p.dbpath
+	s.BlockSize = p.blockSize
 	return
 }
@@ -0,0 +1,61 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+func punchHole(df dataFile, off, n int64) error {
+	f, ok := df.(*os.File)
+	if !ok {
+		return ErrPunchUnsupported
+	}
+	c, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err2 := c.Control(func(fd uintptr) {
+		err = syscall.Fallocate(int(fd), fallocKeepSize|fallocPunchHole, off, n)
+	}); err2 != nil {
+		return err2
+	}
+	return err
+}
+
+func allocatedSize(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
+
+func (s *fileStore) PunchHole(b, n uint32) error {
+	return punchHole(s.f, int64(b)*s.bs, int64(n)*s.bs)
+}
+
+func (s *segmentStore) PunchHole(b, n uint32) error {
+	for n > 0 {
+		k := uint32(s.segBlocks - int64(b)%s.segBlocks)
+		if k > n {
+			k = n
+		}
+		// Missing segments hold nothing to release
+		f, base, err := s.locate(b, false)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == nil {
+			if err := punchHole(f, base, int64(k)*s.bs); err != nil {
+				return err
+			}
+		}
+		b, n = b+k, n-k
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package vfs
+
+import "os"
+
+func allocatedSize(fi os.FileInfo) int64 {
+	return fi.Size()
+}
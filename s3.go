@@ -0,0 +1,621 @@
+package vfs
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MetaPrefix = "X-Amz-Meta-"
+	s3Time       = "2006-01-02T15:04:05.000Z"
+)
+
+// S3Gateway serves a subset of the S3 API over a Package with path style
+// addressing: top-level directories are buckets and tags are user metadata.
+// Requests are not authenticated.
+type S3Gateway struct {
+	Package *Package
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int    `xml:",omitempty"`
+	Marker                string `xml:",omitempty"`
+	NextMarker            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3Part struct {
+	PartNumber   int
+	ETag         string
+	LastModified string `xml:",omitempty"`
+	Size         int64  `xml:",omitempty"`
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key := r.URL.Path[1:], ""
+	if idx := strings.Index(bucket, "/"); idx > -1 {
+		bucket, key = bucket[:idx], bucket[idx+1:]
+	}
+	q := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+			return
+		}
+		g.listBuckets(w, r)
+		return
+	}
+	if strings.HasPrefix(bucket, ".") || !checkName("/"+bucket) {
+		s3Error(w, http.StatusBadRequest, "InvalidBucketName", bucket)
+		return
+	}
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodGet:
+			g.listObjects(w, r, bucket)
+		case http.MethodHead:
+			if !g.bucketExists(bucket) {
+				s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+			}
+		case http.MethodPut:
+			if err := g.Package.Mkdir("/" + bucket); err != nil {
+				s3ErrorFor(w, err)
+			}
+		case http.MethodDelete:
+			g.deleteBucket(w, bucket)
+		default:
+			s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+		}
+		return
+	}
+
+	if !g.bucketExists(bucket) {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	name := "/" + bucket + "/" + key
+	uploadID := q.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		g.initUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && uploadID != "":
+		g.completeUpload(w, r, bucket, key, uploadID)
+	case r.Method == http.MethodPut && uploadID != "":
+		g.uploadPart(w, r, name, uploadID)
+	case r.Method == http.MethodDelete && uploadID != "":
+		g.abortUpload(w, name, uploadID)
+	case r.Method == http.MethodGet && uploadID != "":
+		g.listParts(w, bucket, key, uploadID)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		g.copyObject(w, r, name)
+	case r.Method == http.MethodPut:
+		g.putObject(w, r, name)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		g.getObject(w, r, name)
+	case r.Method == http.MethodDelete:
+		_, err := g.object(name)
+		if err == nil {
+			err = g.Package.Delete(strings.TrimSuffix(name, "/"))
+		} else if err == errObjectType {
+			s3ErrorFor(w, ErrNotFound)
+			return
+		}
+		if err != nil && err != ErrNotFound {
+			s3ErrorFor(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	}
+}
+
+// errObjectType is returned by object if name and the type of its target
+// disagree, S3 clients mark folders with a trailing slash.
+var errObjectType = fmt.Errorf("object type mismatch")
+
+// object returns the meta of name, names with a trailing slash only refer to
+// directories and names without one only to files.
+func (g *S3Gateway) object(name string) (Meta, error) {
+	m, err := g.Package.Info(strings.TrimSuffix(name, "/"))
+	if err == nil && m.IsDir != strings.HasSuffix(name, "/") {
+		err = errObjectType
+	}
+	return m, err
+}
+
+func (g *S3Gateway) bucketExists(bucket string) bool {
+	m, err := g.Package.Info("/" + bucket)
+	return err == nil && m.IsDir
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	metas, err := g.Package.ListContext(r.Context(), "/")
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	res := struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Owner   string     `xml:"Owner>ID"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: "vfs"}
+	for _, m := range metas {
+		if name := strings.Trim(m.Name, "/"); m.IsDir && !strings.HasPrefix(name, ".") {
+			res.Buckets = append(res.Buckets, s3Bucket{name, s3Timestamp(m.ModTime)})
+		}
+	}
+	writeXML(w, res)
+}
+
+func (g *S3Gateway) deleteBucket(w http.ResponseWriter, bucket string) {
+	if !g.bucketExists(bucket) {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	switch err := g.Package.Delete("/" + bucket); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrIsDirectory:
+		s3Error(w, http.StatusConflict, "BucketNotEmpty", bucket)
+	default:
+		s3ErrorFor(w, err)
+	}
+}
+
+// listObjects implements both ListObjects and ListObjectsV2, the only
+// supported delimiter is "/".
+func (g *S3Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !g.bucketExists(bucket) {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	q := r.URL.Query()
+	res := s3ListResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   1000,
+	}
+	if res.Delimiter != "" && res.Delimiter != "/" {
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", "delimiter must be /")
+		return
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3Error(w, http.StatusBadRequest, "InvalidArgument", "max-keys")
+			return
+		}
+		res.MaxKeys = n
+	}
+	v2 := q.Get("list-type") == "2"
+	after := q.Get("marker")
+	if v2 {
+		res.StartAfter, res.ContinuationToken = q.Get("start-after"), q.Get("continuation-token")
+		after = res.StartAfter
+		if res.ContinuationToken != "" {
+			after = res.ContinuationToken
+		}
+	} else {
+		res.Marker = after
+	}
+
+	root := "/" + bucket + "/"
+	dir := root + res.Prefix[:strings.LastIndex(res.Prefix, "/")+1]
+	var last string
+	add := func(m Meta) error {
+		rel := m.Name[len(root):]
+		if !strings.HasPrefix(rel, res.Prefix) || rel <= after {
+			return nil
+		}
+		if len(res.Contents)+len(res.CommonPrefixes) >= res.MaxKeys {
+			// without a key there is nothing to continue from
+			res.IsTruncated = res.MaxKeys > 0
+			return ErrAbort
+		}
+		if m.IsDir {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{rel})
+		} else {
+			res.Contents = append(res.Contents, s3Object{
+				Key:          rel,
+				LastModified: s3Timestamp(m.ModTime),
+				ETag:         `"` + m.ETag() + `"`,
+				Size:         m.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		last = rel
+		return nil
+	}
+
+	var err error
+	if res.Delimiter == "" {
+		err = g.Package.ForEachMetaContext(r.Context(), dir, add)
+	} else {
+		var metas []Meta
+		metas, err = g.Package.ListContext(r.Context(), dir)
+		for _, m := range metas {
+			if add(m) == ErrAbort {
+				break
+			}
+		}
+	}
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = last
+		} else {
+			res.NextMarker = last
+		}
+	}
+	if v2 {
+		res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	}
+	writeXML(w, res)
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, name string) {
+	m, err := g.object(name)
+	if err == errObjectType {
+		err = ErrNotFound
+	}
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	h := w.Header()
+	h.Set("ETag", `"`+m.ETag()+`"`)
+	h.Set("Content-Type", "application/octet-stream")
+	for k, v := range m.Tags {
+		if k == ContentTypeTag {
+			h.Set("Content-Type", v)
+		} else {
+			h.Set(s3MetaPrefix+k, v)
+		}
+	}
+	if m.IsDir {
+		h.Set("Last-Modified", time.Unix(m.ModTime, 0).UTC().Format(http.TimeFormat))
+		return
+	}
+
+	f, err := g.Package.Open(name)
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, "", time.Unix(m.ModTime, 0), f)
+}
+
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, name string) {
+	if strings.HasSuffix(name, "/") { // folder placeholder
+		if err := g.Package.Mkdir(strings.TrimSuffix(name, "/")); err != nil {
+			s3ErrorFor(w, err)
+		}
+		return
+	}
+	err := g.Package.If(headerConds(r.Header)...).WriteContext(r.Context(), name, s3Body(r), s3Tags(r.Header)...)
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	if m, err := g.Package.Info(name); err == nil {
+		w.Header().Set("ETag", `"`+m.ETag()+`"`)
+	}
+}
+
+func (g *S3Gateway) copyObject(w http.ResponseWriter, r *http.Request, name string) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "InvalidArgument", "x-amz-copy-source")
+		return
+	}
+	if idx := strings.Index(src, "?"); idx > -1 {
+		src = src[:idx]
+	}
+	src = "/" + strings.TrimPrefix(src, "/")
+	if strings.HasPrefix(src, "/.") {
+		s3Error(w, http.StatusBadRequest, "InvalidBucketName", src)
+		return
+	}
+	if err := g.Package.Copy(src, name, true); err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		kvs := s3Tags(r.Header)
+		if err := g.Package.UpdateTags(name, func(tags map[string]string) error {
+			for k := range tags {
+				delete(tags, k)
+			}
+			for i := 0; i < len(kvs); i += 2 {
+				tags[kvs[i]] = kvs[i+1]
+			}
+			return nil
+		}); err != nil {
+			s3ErrorFor(w, err)
+			return
+		}
+	}
+	m, err := g.Package.Info(name)
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		LastModified string
+		ETag         string
+	}{LastModified: s3Timestamp(m.ModTime), ETag: `"` + m.ETag() + `"`})
+}
+
+func partETag(crc uint32) string {
+	return fmt.Sprintf(`"%08x"`, crc)
+}
+
+// upload returns the pending upload id of name.
+func (g *S3Gateway) upload(w http.ResponseWriter, name, id string) (Upload, bool) {
+	u, err := g.Package.Upload(id)
+	if err != nil || u.Key != name {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", id)
+		return u, false
+	}
+	return u, true
+}
+
+func (g *S3Gateway) initUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id, err := g.Package.InitUpload("/"+bucket+"/"+key, s3Tags(r.Header)...)
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, name, id string) {
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		s3Error(w, http.StatusBadRequest, "InvalidArgument", "partNumber")
+		return
+	}
+	if _, ok := g.upload(w, name, id); !ok {
+		return
+	}
+	if err := g.Package.UploadPartContext(r.Context(), id, n, s3Body(r)); err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	parts, _ := g.Package.ListParts(id)
+	for _, part := range parts {
+		if part.N == n {
+			w.Header().Set("ETag", partETag(part.Crc32))
+		}
+	}
+}
+
+func (g *S3Gateway) listParts(w http.ResponseWriter, bucket, key, id string) {
+	u, ok := g.upload(w, "/"+bucket+"/"+key, id)
+	if !ok {
+		return
+	}
+	res := struct {
+		XMLName  xml.Name `xml:"ListPartsResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+		Parts    []s3Part `xml:"Part"`
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: id}
+	for _, part := range u.Parts {
+		res.Parts = append(res.Parts, s3Part{part.N, partETag(part.Crc32), s3Timestamp(part.ModTime), part.Size})
+	}
+	writeXML(w, res)
+}
+
+func (g *S3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	name := "/" + bucket + "/" + key
+	u, ok := g.upload(w, name, id)
+	if !ok {
+		return
+	}
+	var req struct {
+		Parts []s3Part `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		s3Error(w, http.StatusBadRequest, "MalformedXML", "")
+		return
+	}
+
+	etags := map[int]string{}
+	for _, part := range u.Parts {
+		etags[part.N] = partETag(part.Crc32)
+	}
+	parts := make([]int, len(req.Parts))
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			s3Error(w, http.StatusBadRequest, "InvalidPartOrder", "")
+			return
+		}
+		if etags[part.PartNumber] != `"`+strings.Trim(part.ETag, `"`)+`"` {
+			s3Error(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(part.PartNumber))
+			return
+		}
+		parts[i] = part.PartNumber
+	}
+
+	if err := g.Package.CompleteUploadContext(r.Context(), id, parts); err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	m, err := g.Package.Info(name)
+	if err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, ETag: `"` + m.ETag() + `"`})
+}
+
+func (g *S3Gateway) abortUpload(w http.ResponseWriter, name, id string) {
+	if _, ok := g.upload(w, name, id); !ok {
+		return
+	}
+	if err := g.Package.AbortUpload(id); err != nil {
+		s3ErrorFor(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3Tags converts user metadata and Content-Type to tags.
+func s3Tags(h http.Header) []string {
+	var kvs []string
+	for k, v := range h {
+		if strings.HasPrefix(k, s3MetaPrefix) && len(v) > 0 {
+			kvs = append(kvs, strings.ToLower(k[len(s3MetaPrefix):]), v[0])
+		}
+	}
+	if ct := h.Get("Content-Type"); ct != "" {
+		kvs = append(kvs, ContentTypeTag, ct)
+	}
+	return kvs
+}
+
+func s3Timestamp(sec int64) string {
+	return time.Unix(sec, 0).UTC().Format(s3Time)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func s3Error(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: msg})
+}
+
+func s3ErrorFor(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotFound:
+		s3Error(w, http.StatusNotFound, "NoSuchKey", err.Error())
+	case ErrInvalidName:
+		s3Error(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+	case ErrIsDirectory:
+		s3Error(w, http.StatusConflict, "InvalidRequest", err.Error())
+	case ErrPreconditionFailed:
+		s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", err.Error())
+	default:
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+// s3Body decodes the aws-chunked encoding used by signed streaming uploads,
+// chunk signatures and trailers are ignored.
+func s3Body(r *http.Request) io.Reader {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return &awsChunkedReader{r: bufio.NewReader(r.Body)}
+	}
+	return r.Body
+}
+
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue // CRLF after chunk data
+		}
+		if idx := strings.Index(line, ";"); idx > -1 {
+			line = line[:idx]
+		}
+		n, err := strconv.ParseInt(line, 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("aws-chunked: invalid chunk size %q", line)
+		}
+		c.left, c.done = n, n == 0
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF && c.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
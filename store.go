@@ -0,0 +1,476 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BlockStore holds data blocks of a Package. Blocks are numbered from 0 and
+// are BlockSize() bytes long. Implementations must support concurrent reads
+// and writes of different blocks.
+type BlockStore interface {
+	BlockSize() int64
+	// ReadBlock reads len(p) bytes of block b starting at offset off.
+	ReadBlock(b uint32, off int64, p []byte) (int, error)
+	// WriteBlock writes p to block b at offset off, growing the store if needed.
+	WriteBlock(b uint32, off int64, p []byte) error
+	// Truncate drops all blocks starting from block n.
+	Truncate(n int64) error
+	Sync() error
+	// Size returns the size of the store in bytes.
+	Size() (int64, error)
+	Close() error
+}
+
+// dataFile is a file holding blocks.
+type dataFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Close() error
+	Name() string
+}
+
+// fileSystem opens the files of a package, tests provide their own to inject
+// faults.
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (dataFile, error)
+	// OpenIndex opens the index, bbolt needs an *os.File to map it.
+	OpenIndex(name string, flag int, perm os.FileMode) (*os.File, error)
+}
+
+// osFS opens files of the operating system.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (dataFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenIndex(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// holePuncher is implemented by stores which can release the disk space of
+// blocks while keeping the numbers of the following ones, reading a punched
+// block returns zeros.
+type holePuncher interface {
+	PunchHole(b, n uint32) error
+}
+
+// fileStore stores all blocks in a single file.
+type fileStore struct {
+	f  dataFile
+	bs int64
+}
+
+func openFileStore(fs fileSystem, path string, blockSize int64) (*fileStore, error) {
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{f: f, bs: blockSize}, nil
+}
+
+func (s *fileStore) BlockSize() int64 {
+	return s.bs
+}
+
+func (s *fileStore) ReadBlock(b uint32, off int64, p []byte) (int, error) {
+	return s.f.ReadAt(p, int64(b)*s.bs+off)
+}
+
+func (s *fileStore) WriteBlock(b uint32, off int64, p []byte) error {
+	n, err := s.f.WriteAt(p, int64(b)*s.bs+off)
+	if err == nil && n != len(p) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+func (s *fileStore) Truncate(n int64) error {
+	if size, err := s.Size(); err != nil || size <= n*s.bs {
+		return err
+	}
+	return s.f.Truncate(n * s.bs)
+}
+
+func (s *fileStore) Sync() error {
+	return s.f.Sync()
+}
+
+func (s *fileStore) Size() (int64, error) {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// AllocatedSize returns the disk space used by the store, which is less than
+// its size if it has holes.
+func (s *fileStore) AllocatedSize() (int64, error) {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return allocatedSize(fi), nil
+}
+
+func (s *fileStore) Close() error {
+	return s.f.Close()
+}
+
+func (s *fileStore) Path() string {
+	return s.f.Name()
+}
+
+// openDataStore opens the data of a package at path, split into segments of
+// segBlocks blocks if segBlocks is not 0.
+func openDataStore(fs fileSystem, path string, blockSize, segBlocks int64) (BlockStore, error) {
+	if segBlocks > 0 {
+		return openSegmentStore(fs, path+".", blockSize, segBlocks)
+	}
+	return openFileStore(fs, path, blockSize)
+}
+
+// MemStore keeps blocks in memory.
+type MemStore struct {
+	mu     sync.RWMutex
+	bs     int64
+	blocks [][]byte
+}
+
+func NewMemStore(blockSize int64) *MemStore {
+	return &MemStore{bs: blockSize}
+}
+
+func (s *MemStore) BlockSize() int64 {
+	return s.bs
+}
+
+func (s *MemStore) ReadBlock(b uint32, off int64, p []byte) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if int(b) >= len(s.blocks) || off >= s.bs {
+		return 0, io.EOF
+	}
+	if s.blocks[b] == nil { // punched
+		n := copy(p, make([]byte, s.bs-off))
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	n := copy(p, s.blocks[b][off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *MemStore) WriteBlock(b uint32, off int64, p []byte) error {
+	if off+int64(len(p)) > s.bs {
+		return fmt.Errorf("write block: %d bytes at %d overflow", len(p), off)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for int(b) >= len(s.blocks) {
+		s.blocks = append(s.blocks, make([]byte, s.bs))
+	}
+	if s.blocks[b] == nil {
+		s.blocks[b] = make([]byte, s.bs)
+	}
+	copy(s.blocks[b][off:], p)
+	return nil
+}
+
+func (s *MemStore) Truncate(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(len(s.blocks)) > n {
+		for i := n; i < int64(len(s.blocks)); i++ {
+			s.blocks[i] = nil
+		}
+		s.blocks = s.blocks[:n]
+	}
+	return nil
+}
+
+func (s *MemStore) Sync() error { return nil }
+
+func (s *MemStore) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.blocks)) * s.bs, nil
+}
+
+func (s *MemStore) PunchHole(b, n uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := int64(b); i < int64(b)+int64(n) && i < int64(len(s.blocks)); i++ {
+		s.blocks[i] = nil
+	}
+	return nil
+}
+
+func (s *MemStore) AllocatedSize() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := int64(0)
+	for _, b := range s.blocks {
+		if b != nil {
+			n += s.bs
+		}
+	}
+	return n, nil
+}
+
+func (s *MemStore) Close() error { return nil }
+
+// segmentStore splits blocks into segment files of segBlocks blocks each,
+// named prefix followed by the 4 digits segment number. Missing segments are
+// holes, reading them fails and writing creates them again.
+type segmentStore struct {
+	fs        fileSystem
+	prefix    string
+	bs        int64
+	segBlocks int64
+	mu        sync.RWMutex
+	segs      []dataFile // nil for missing segments, never the last one
+}
+
+// OpenSegmentStore opens a store of blockSize blocks keeping segmentSize bytes
+// in every file of dir, segmentSize must be a multiple of blockSize.
+func OpenSegmentStore(dir string, blockSize, segmentSize int64) (BlockStore, error) {
+	if blockSize <= 0 || segmentSize <= 0 || segmentSize%blockSize != 0 {
+		return nil, fmt.Errorf("segment size %d: not a multiple of block size", segmentSize)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return openSegmentStore(osFS{}, filepath.Join(dir, "seg."), blockSize, segmentSize/blockSize)
+}
+
+func openSegmentStore(fs fileSystem, prefix string, blockSize, segBlocks int64) (*segmentStore, error) {
+	s := &segmentStore{fs: fs, prefix: prefix, bs: blockSize, segBlocks: segBlocks}
+	entries, err := os.ReadDir(filepath.Dir(prefix))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	base := filepath.Base(prefix)
+	for _, e := range entries {
+		i, err := strconv.Atoi(strings.TrimPrefix(e.Name(), base))
+		if !strings.HasPrefix(e.Name(), base) || err != nil || i < 0 || s.segName(i) != filepath.Join(filepath.Dir(prefix), e.Name()) {
+			continue
+		}
+		f, err := s.fs.OpenFile(s.segName(i), os.O_RDWR, 0777)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		for len(s.segs) <= i {
+			s.segs = append(s.segs, nil)
+		}
+		s.segs[i] = f
+	}
+	return s, nil
+}
+
+// checkGaps fails if a block below end is in use according to used but lies
+// in a missing segment.
+func (s *segmentStore) checkGaps(used func(b uint32) bool, end int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := 0; int64(i)*s.segBlocks < end; i++ {
+		if i < len(s.segs) && s.segs[i] != nil {
+			continue
+		}
+		for b := int64(i) * s.segBlocks; b < int64(i+1)*s.segBlocks && b < end; b++ {
+			if used(uint32(b)) {
+				return fmt.Errorf("segment %s: missing, block %d is in use", s.segName(i), b)
+			}
+		}
+	}
+	return nil
+}
+
+// drop removes segment i.
+func (s *segmentStore) drop(i int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i >= len(s.segs) || s.segs[i] == nil {
+		return nil
+	}
+	f := s.segs[i]
+	f.Close()
+	s.segs[i] = nil
+	for len(s.segs) > 0 && s.segs[len(s.segs)-1] == nil {
+		s.segs = s.segs[:len(s.segs)-1]
+	}
+	return os.Remove(f.Name())
+}
+
+func (s *segmentStore) BlockSize() int64 {
+	return s.bs
+}
+
+func (s *segmentStore) segName(i int) string {
+	return fmt.Sprintf("%s%04d", s.prefix, i)
+}
+
+// locate returns the segment of block b and the offset of b in it, creating
+// segments up to it if grow is set.
+func (s *segmentStore) locate(b uint32, grow bool) (dataFile, int64, error) {
+	i, off := int(int64(b)/s.segBlocks), int64(b)%s.segBlocks*s.bs
+	s.mu.RLock()
+	if i < len(s.segs) && s.segs[i] != nil {
+		f := s.segs[i]
+		s.mu.RUnlock()
+		return f, off, nil
+	}
+	s.mu.RUnlock()
+	if !grow {
+		return nil, 0, io.EOF
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segs) <= i {
+		s.segs = append(s.segs, nil)
+	}
+	if s.segs[i] == nil {
+		f, err := s.fs.OpenFile(s.segName(i), os.O_CREATE|os.O_RDWR, 0777)
+		if err != nil {
+			for len(s.segs) > 0 && s.segs[len(s.segs)-1] == nil {
+				s.segs = s.segs[:len(s.segs)-1]
+			}
+			return nil, 0, err
+		}
+		s.segs[i] = f
+	}
+	return s.segs[i], off, nil
+}
+
+func (s *segmentStore) ReadBlock(b uint32, off int64, p []byte) (int, error) {
+	f, base, err := s.locate(b, false)
+	if err != nil {
+		return 0, err
+	}
+	return f.ReadAt(p, base+off)
+}
+
+func (s *segmentStore) WriteBlock(b uint32, off int64, p []byte) error {
+	f, base, err := s.locate(b, true)
+	if err != nil {
+		return err
+	}
+	n, err := f.WriteAt(p, base+off)
+	if err == nil && n != len(p) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+func (s *segmentStore) Truncate(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keep := int((n + s.segBlocks - 1) / s.segBlocks)
+	if keep > len(s.segs) {
+		return nil
+	}
+	for len(s.segs) > keep {
+		if f := s.segs[len(s.segs)-1]; f != nil {
+			f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				return err
+			}
+		}
+		s.segs = s.segs[:len(s.segs)-1]
+	}
+	for len(s.segs) > 0 && s.segs[len(s.segs)-1] == nil {
+		s.segs = s.segs[:len(s.segs)-1]
+	}
+	if keep == 0 || len(s.segs) < keep {
+		return nil
+	}
+	last := s.segs[keep-1]
+	size := (n - int64(keep-1)*s.segBlocks) * s.bs
+	if fi, err := last.Stat(); err != nil || fi.Size() <= size {
+		return err
+	}
+	return last.Truncate(size)
+}
+
+func (s *segmentStore) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.segs {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *segmentStore) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.segs) == 0 {
+		return 0, nil
+	}
+	fi, err := s.segs[len(s.segs)-1].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(s.segs)-1)*s.segBlocks*s.bs + fi.Size(), nil
+}
+
+func (s *segmentStore) AllocatedSize() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := int64(0)
+	for _, f := range s.segs {
+		if f == nil {
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		n += allocatedSize(fi)
+	}
+	return n, nil
+}
+
+func (s *segmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, f := range s.segs {
+		if f == nil {
+			continue
+		}
+		if err1 := f.Close(); err1 != nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+func (s *segmentStore) Path() string {
+	return s.prefix + "*"
+}
@@ -0,0 +1,398 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Every pending upload is a bucket in uploadsBucket, holding uploadInfoKey and
+// the metas of its parts keyed by part number. Blocks of parts are marked as
+// used, so uploads survive restarts.
+var uploadInfoKey = []byte("info")
+
+// Upload is a pending multipart upload.
+type Upload struct {
+	ID         string            `json:"-"`
+	Key        string            `json:"k"`
+	Tags       map[string]string `json:"T,omitempty"`
+	CreateTime int64             `json:"ct"`
+	ModTime    int64             `json:"mt"` // time of the last uploaded part
+	Parts      []Part            `json:"-"`
+}
+
+type Part struct {
+	N       int
+	Size    int64
+	Crc32   uint32
+	ModTime int64
+}
+
+// InitUpload starts a multipart upload of key, the file is created with tags
+// kvs by CompleteUpload.
+func (p *Package) InitUpload(key string, kvs ...string) (string, error) {
+	if !checkName(key) {
+		return "", ErrInvalidName
+	}
+	if len(kvs)%2 == 1 {
+		return "", fmt.Errorf("init upload: invalid key value pairs")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	buf, _ := json.Marshal(Upload{Key: key, Tags: kvsToMap(kvs...), CreateTime: now, ModTime: now})
+	return hex.EncodeToString(id), p.db.Update(func(tx *bbolt.Tx) error {
+		bk, err := tx.Bucket(uploadsBucket).CreateBucket([]byte(hex.EncodeToString(id)))
+		if err != nil {
+			return err
+		}
+		return bk.Put(uploadInfoKey, buf)
+	})
+}
+
+func uploadTx(tx *bbolt.Tx, id string) (*bbolt.Bucket, Upload, error) {
+	u := Upload{ID: id}
+	bk := tx.Bucket(uploadsBucket).Bucket([]byte(id))
+	if bk == nil {
+		return nil, u, ErrNoSuchUpload
+	}
+	err := json.Unmarshal(bk.Get(uploadInfoKey), &u)
+	return bk, u, err
+}
+
+func (p *Package) UploadPart(id string, n int, r io.Reader) error {
+	return p.UploadPartContext(context.Background(), id, n, r)
+}
+
+// UploadPartContext stores r as part n of upload id, replacing the previous
+// part n if any. Parts are committed independently, so an interrupted upload
+// only needs to resend its missing parts.
+func (p *Package) UploadPartContext(ctx context.Context, id string, n int, r io.Reader) error {
+	if n < 1 {
+		return fmt.Errorf("upload part: invalid part number %d", n)
+	}
+	if err := p.db.View(func(tx *bbolt.Tx) error {
+		_, _, err := uploadTx(tx, id)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	m := Meta{ModTime: time.Now().Unix()}
+	reserved, err := p.ioCopy(ctx, &m, r, p.newClaim(remaining(r)))
+	if err != nil {
+		return err
+	}
+	return p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
+		bk, u, err := uploadTx(tx, id)
+		if err != nil {
+			return err
+		}
+		k := int64ToBytes(int64(n))
+		if old := bk.Get(k); len(old) > 0 {
+			m, err := unmarshalMeta(old, p.blockSize)
+			if err != nil {
+				return err
+			}
+			st.freed.add(m)
+		}
+		u.ModTime = m.ModTime
+		buf, _ := json.Marshal(u)
+		if err := bk.Put(uploadInfoKey, buf); err != nil {
+			return err
+		}
+		return bk.Put(k, m.marshal())
+	})
+}
+
+// Upload returns the pending upload id with its parts.
+func (p *Package) Upload(id string) (u Upload, err error) {
+	err = p.db.View(func(tx *bbolt.Tx) error {
+		var bk *bbolt.Bucket
+		if bk, u, err = uploadTx(tx, id); err != nil {
+			return err
+		}
+		return bk.ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, uploadInfoKey) {
+				m, err := unmarshalMeta(v, p.blockSize)
+				if err != nil {
+					return err
+				}
+				u.Parts = append(u.Parts, Part{int(bytesToInt64(k)), m.Size, m.Crc32, m.ModTime})
+			}
+			return nil
+		})
+	})
+	return u, err
+}
+
+func (p *Package) ListParts(id string) ([]Part, error) {
+	u, err := p.Upload(id)
+	return u.Parts, err
+}
+
+// Uploads returns pending uploads of keys under prefix, without their parts.
+func (p *Package) Uploads(prefix string) (uploads []Upload, err error) {
+	err = p.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(k, v []byte) error {
+			_, u, err := uploadTx(tx, string(k))
+			if err == nil && strings.HasPrefix(u.Key, prefix) {
+				uploads = append(uploads, u)
+			}
+			return err
+		})
+	})
+	return uploads, err
+}
+
+func (p *Package) CompleteUpload(id string, parts []int) error {
+	return p.CompleteUploadContext(context.Background(), id, parts)
+}
+
+// CompleteUploadContext creates the file of upload id from parts in the given
+// order, parts not listed are dropped. The blocks of parts become the blocks
+// of the file without copying, as long as all parts but the last are multiples
+// of the block size, otherwise data is copied into new blocks.
+func (p *Package) CompleteUploadContext(ctx context.Context, id string, parts []int) error {
+	if len(parts) == 0 {
+		return fmt.Errorf("complete upload: no parts")
+	}
+	var u Upload
+	metas := make([]Meta, len(parts))
+	// load reads the listed parts, or checks they are unchanged since read
+	loaded := false
+	load := func(tx *bbolt.Tx) (*bbolt.Bucket, error) {
+		bk, info, err := uploadTx(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		u = info
+		for i, n := range parts {
+			if i > 0 && n <= parts[i-1] {
+				return nil, fmt.Errorf("complete upload: parts must be in ascending order")
+			}
+			v := bk.Get(int64ToBytes(int64(n)))
+			if len(v) == 0 {
+				return nil, fmt.Errorf("complete upload: part %d not found", n)
+			}
+			m, err := unmarshalMeta(v, p.blockSize)
+			if err != nil {
+				return nil, err
+			}
+			if loaded && !bytes.Equal(m.marshal(), metas[i].marshal()) {
+				return nil, fmt.Errorf("complete upload: part %d modified concurrently", n)
+			}
+			metas[i] = m
+		}
+		loaded = true
+		return bk, nil
+	}
+	if err := p.db.View(func(tx *bbolt.Tx) error {
+		_, err := load(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, len(metas))
+	for i, m := range metas {
+		f, err := p.openMeta(m)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers[i] = f
+	}
+	head, rest, err := p.readHead(io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	op := &Operation{Op: OpWrite, Name: u.Key, Tags: u.Tags, Head: head}
+	if err := p.before(false, op); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	op.m = Meta{Name: u.Key, CreateTime: now, ModTime: now}
+	stitch := true
+	for _, m := range metas[:len(metas)-1] {
+		stitch = stitch && m.Size%p.blockSize == 0
+	}
+	var reserved space
+	if stitch {
+		for _, m := range metas {
+			op.m.Positions = append(op.m.Positions, m.Positions...)
+			op.m.Tail = m.Tail // only the last part may have one
+			op.m.Crc32 = crc32Combine(op.m.Crc32, m.Crc32, m.Size)
+			op.m.Size += m.Size
+		}
+	} else if reserved, err = p.copyData(ctx, &op.m, head, rest); err != nil {
+		return err
+	}
+
+	return p.update(reserved, func(tx *bbolt.Tx, st *txState) error {
+		bk, err := load(tx)
+		if err != nil {
+			return err
+		}
+		if err := bk.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, uploadInfoKey) {
+				return nil
+			}
+			m, err := unmarshalMeta(v, p.blockSize)
+			st.freed.add(m)
+			return err
+		}); err != nil {
+			return err
+		}
+		if stitch {
+			st.freed.subtract(op.m)
+		}
+		if err := tx.Bucket(uploadsBucket).DeleteBucket([]byte(id)); err != nil {
+			return err
+		}
+		return p.writeTx(tx, st, op, nil)
+	})
+}
+
+// subtractBlocks returns blocks of a not in b.
+func subtractBlocks(a, b Blocks) Blocks {
+	drop := map[uint32]bool{}
+	b.ForEach(func(v uint32) error {
+		drop[v] = true
+		return nil
+	})
+	var res Blocks
+	a.ForEach(func(v uint32) error {
+		if !drop[v] {
+			res.Append(v)
+		}
+		return nil
+	})
+	return res
+}
+
+// AbortUpload drops upload id and frees its parts.
+func (p *Package) AbortUpload(id string) error {
+	return p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		return p.abortUploadTx(tx, st, id)
+	})
+}
+
+func (p *Package) abortUploadTx(tx *bbolt.Tx, st *txState, id string) error {
+	bk, _, err := uploadTx(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := bk.ForEach(func(k, v []byte) error {
+		if bytes.Equal(k, uploadInfoKey) {
+			return nil
+		}
+		m, err := unmarshalMeta(v, p.blockSize)
+		st.freed.add(m)
+		return err
+	}); err != nil {
+		return err
+	}
+	return tx.Bucket(uploadsBucket).DeleteBucket([]byte(id))
+}
+
+// CleanUploads aborts uploads which have not received any part for ttl and
+// returns their number.
+func (p *Package) CleanUploads(ttl time.Duration) (n int, err error) {
+	deadline := time.Now().Add(-ttl).Unix()
+	err = p.update(space{}, func(tx *bbolt.Tx, st *txState) error {
+		var stale []string
+		if err := tx.Bucket(uploadsBucket).ForEach(func(k, v []byte) error {
+			if _, u, err := uploadTx(tx, string(k)); err != nil || u.ModTime < deadline {
+				stale = append(stale, string(k))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range stale {
+			if err := p.abortUploadTx(tx, st, id); err != nil {
+				return err
+			}
+		}
+		n = len(stale)
+		return nil
+	})
+	return n, err
+}
+
+func (p *Package) uploadJanitor(ttl time.Duration) {
+	interval := ttl / 2
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.CleanUploads(ttl)
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// crc32Combine returns the CRC32 of A followed by B from the CRC32 of A, the
+// CRC32 of B and the length of B, it is crc32_combine of zlib.
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	times := func(mat *[32]uint32, vec uint32) (sum uint32) {
+		for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+			if vec&1 != 0 {
+				sum ^= mat[i]
+			}
+		}
+		return sum
+	}
+	square := func(sq, mat *[32]uint32) {
+		for i := range sq {
+			sq[i] = times(mat, mat[i])
+		}
+	}
+
+	var even, odd [32]uint32
+	odd[0] = crc32.IEEE // operator for one zero bit
+	for i, row := 1, uint32(1); i < 32; i, row = i+1, row<<1 {
+		odd[i] = row
+	}
+	square(&even, &odd) // two zero bits
+	square(&odd, &even) // four zero bits
+	for {
+		// Apply len2 zero bytes to crc1, the first square puts the operator for one zero byte in even
+		square(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = times(&even, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+		square(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = times(&odd, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
-	"os"
+	"sort"
 	"strings"
 )
 
@@ -23,11 +23,14 @@ func assert(v bool) {
 }
 
 type File struct {
-	f       *os.File
-	size    int64
-	offsets []int64
-	cursor  int64
-	small   []byte
+	store     BlockStore
+	blockSize int64
+	size      int64
+	runs      []blockRun
+	nblocks   int64
+	tail      *Extent
+	cursor    int64
+	small     []byte
 }
 
 func (f *File) Size() int64 {
@@ -35,27 +38,41 @@ func (f *File) Size() int64 {
 }
 
 func (r *File) Seek(offset int64, whence int) (int64, error) {
+	cursor := r.cursor
 	switch whence {
-	case 0:
-		r.cursor = offset
-	case 1:
-		r.cursor += offset
-	case 2:
-		r.cursor = r.size + offset
+	case io.SeekStart:
+		cursor = offset
+	case io.SeekCurrent:
+		cursor += offset
+	case io.SeekEnd:
+		cursor = r.size + offset
 	default:
 		return 0, fmt.Errorf("invalid whence")
 	}
-	if r.cursor < 0 || r.cursor >= r.size {
-		return 0, fmt.Errorf("invalid cursor: %v", r.cursor)
+	// Seeking to or beyond the end is allowed, Read returns io.EOF there
+	if cursor < 0 {
+		return 0, fmt.Errorf("invalid cursor: %v", cursor)
 	}
+	r.cursor = cursor
 	return r.cursor, nil
 }
 
 func (r *File) Close() error {
-	if r.f == nil {
-		return nil
-	}
-	return r.f.Close()
+	return nil
+}
+
+// blockRun is a run of blocks of a File.
+type blockRun struct {
+	first int64 // index of the first block of the run in the file
+	start uint32
+	n     uint32
+}
+
+// block returns the block holding the idx-th block of the file.
+func (r *File) block(idx int64) uint32 {
+	i := sort.Search(len(r.runs), func(i int) bool { return r.runs[i].first+int64(r.runs[i].n) > idx })
+	assert(i < len(r.runs))
+	return r.runs[i].start + uint32(idx-r.runs[i].first)
 }
 
 func (r *File) Read(p []byte) (int, error) {
@@ -63,36 +80,33 @@ func (r *File) Read(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
-	if r.f == nil { // use r.small
+	if r.store == nil { // use r.small
 		n := copy(p, r.small[r.cursor:])
 		r.cursor += int64(n)
 		return n, nil
 	}
 
-	idx := r.cursor / BlockSize
-	assert(int(idx) < len(r.offsets))
-
-	_, err := r.f.Seek(r.offsets[idx]+r.cursor-idx*BlockSize, 0)
-	if err != nil {
-		return 0, err
+	idx := r.cursor / r.blockSize
+	cursorInBlock := r.cursor % r.blockSize
+	left := r.blockSize - cursorInBlock
+	if rest := r.size - r.cursor; left > rest {
+		left = rest
+	}
+	if len(p) > int(left) {
+		p = p[:left]
 	}
 
-	cursorInBlock := r.cursor - r.cursor/BlockSize*BlockSize
-	var left int64
-	if int(idx) == len(r.offsets)-1 {
-		lastBlockSize := r.size % BlockSize
-		if lastBlockSize == 0 {
-			lastBlockSize = BlockSize
-		}
-		left = lastBlockSize - cursorInBlock
+	var n int
+	var err error
+	if idx < r.nblocks {
+		n, err = r.store.ReadBlock(r.block(idx), cursorInBlock, p)
 	} else {
-		left = BlockSize - cursorInBlock
+		assert(r.tail != nil)
+		n, err = r.store.ReadBlock(r.tail.Block, r.tail.Off+cursorInBlock, p)
 	}
-
-	if len(p) > int(left) {
-		p = p[:left]
+	if n == len(p) {
+		err = nil // io.ReaderAt may return io.EOF at the end of the store
 	}
-	n, err := r.f.Read(p)
 	r.cursor += int64(n)
 	return n, err
 }
@@ -1,34 +1,46 @@
 package vfs
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"go.etcd.io/bbolt"
 )
 
 func init() {
 	rand.Seed(time.Now().Unix())
 }
 
-func write(name string, buf []byte) {
-	ioutil.WriteFile("test"+name, buf, 0777)
+// write, read and hash access copies of files kept in dir for comparison.
+func write(dir, name string, buf []byte) {
+	ioutil.WriteFile(dir+name, buf, 0777)
 }
 
-func read(name string) (buf []byte) {
-	buf, _ = ioutil.ReadFile("test" + name)
+func read(dir, name string) (buf []byte) {
+	buf, _ = ioutil.ReadFile(dir + name)
 	return
 }
 
-func hash(name string) uint32 {
-	buf, _ := ioutil.ReadFile("test" + name)
+func hash(dir, name string) uint32 {
+	buf, _ := ioutil.ReadFile(dir + name)
 	return crc32.ChecksumIEEE(buf)
 }
 
@@ -37,12 +49,13 @@ func TestConst(t *testing.T) {
 	run(t, 5)
 }
 
+// run writes, appends and deletes random files, v makes about one in v
+// operations on the data file fail after writing part of the data.
 func run(t *testing.T, v int) {
-	testFlagSimulateDataWriteError = v
-	os.RemoveAll("test")
-	os.MkdirAll("test", 0777)
+	fs := &faultFS{rng: rand.New(rand.NewSource(time.Now().UnixNano())), failEvery: v}
+	dir := t.TempDir()
 
-	p, err := Open("test")
+	p, err := Open(filepath.Join(dir, "test"), OpenOptions{fs: fs})
 	if err != nil {
 		panic(err)
 	}
@@ -57,8 +70,8 @@ func run(t *testing.T, v int) {
 	// return
 
 	m := map[string]int{}
-	if key := "/zero"; fmt.Sprint(p.Write(key, nil)) != "testable" {
-		write(key, nil)
+	if key := "/zero"; !isInjected(p.Write(key, nil)) {
+		write(dir, key, nil)
 		m[key] = 1
 	}
 
@@ -76,28 +89,28 @@ func run(t *testing.T, v int) {
 			appends[key] = x[BlockSize:]
 			x = x[:BlockSize]
 		}
-		if fmt.Sprint(p.Write(key, bytes.NewReader(x))) != "testable" {
-			write(key, full)
+		if !isInjected(p.Write(key, bytes.NewReader(x))) {
+			write(dir, key, full)
 			m[key] = 1
 		} else {
 			delete(appends, key)
 		}
 	}
 
-	oldFlag := testFlagSimulateDataWriteError
+	oldFlag := fs.failEvery
 	for key, x := range appends {
 		fmt.Println("append", key)
 	AGAIN:
 		if err := p.Append(key, bytes.NewReader(x)); err != nil {
-			if fmt.Sprint(err) != "testable" {
+			if !isInjected(err) {
 				panic(err)
 			}
 			fmt.Println("append", key, "retry")
-			testFlagSimulateDataWriteError *= 2
+			fs.failEvery *= 2
 			goto AGAIN
 		}
 	}
-	testFlagSimulateDataWriteError = oldFlag
+	fs.failEvery = oldFlag
 
 	if true {
 		for k := range m {
@@ -117,8 +130,8 @@ func run(t *testing.T, v int) {
 				x = random(rand.Intn(4 * 1024 * 1024))
 			}
 			key := "/zzz" + strconv.Itoa(i)
-			if fmt.Sprint(p.Write(key, bytes.NewReader(x))) != "testable" {
-				write(key, x)
+			if !isInjected(p.Write(key, bytes.NewReader(x))) {
+				write(dir, key, x)
 				m[key] = 1
 			}
 		}
@@ -126,15 +139,15 @@ func run(t *testing.T, v int) {
 
 	for k := range m {
 		buf1, _ := p.ReadAll(k)
-		buf2 := read(k)
+		buf2 := read(dir, k)
 		if !bytes.Equal(buf1, buf2) {
-			write("a", buf1)
-			write("b", buf2)
+			write(dir, "/a", buf1)
+			write(dir, "/b", buf2)
 			t.Fatal(k, len(buf1), len(buf2))
 		}
 
 		m, _ := p.Info(k)
-		if h := hash(k); m.Crc32 != h {
+		if h := hash(dir, k); m.Crc32 != h {
 			t.Fatal(k, m.Crc32, h)
 		}
 
@@ -144,7 +157,7 @@ func run(t *testing.T, v int) {
 		func() {
 			f1, _ := p.Open(k)
 			defer f1.Close()
-			f2, _ := os.Open("test/" + k)
+			f2, _ := os.Open(dir + k)
 			defer f2.Close()
 
 			sz := f1.size
@@ -172,7 +185,7 @@ func run(t *testing.T, v int) {
 }
 
 func TestDir(t *testing.T) {
-	p, _ := Open("test")
+	p := openTest(t)
 	p.WriteAll("/a.txt", []byte("1"))
 	p.WriteAll("/c.txt", []byte("1"))
 	p.WriteAll("/b/a.txt", []byte("1"))
@@ -187,20 +200,33 @@ func TestDir(t *testing.T) {
 }
 
 func TestWalk(t *testing.T) {
-	p, _ := Open("testtmp")
+	dir := t.TempDir()
+	p, err := Open(filepath.Join(dir, "testtmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
 	hh := map[string]uint32{}
 	total := 0
 	start := time.Now()
-	testFlagSimulateDataWriteError = 0
 	filepath.Walk(os.TempDir(), func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
 		if info.IsDir() {
+			if path == dir { // the package itself
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
 			return nil
 		}
 
-		f, _ := os.Open(path)
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
 		defer f.Close()
 
 		h := crc32.NewIEEE()
@@ -231,8 +257,13 @@ func TestWalk(t *testing.T) {
 }
 
 func TestList(t *testing.T) {
-	p, _ := Open("testtmp")
-	fmt.Println(listrec(p, "/"))
+	p := openTest(t)
+	for _, key := range []string{"/a", "/var/b", "/var/c/d", "/var/c/e", "/Users/f"} {
+		p.WriteAll(key, []byte(key))
+	}
+	if n := listrec(p, "/"); n != 5 {
+		t.Fatal(n)
+	}
 	fmt.Println(p.Info("/Users"))
 	fmt.Println(p.Info("/var"))
 }
@@ -250,3 +281,2218 @@ func listrec(p *Package, root string) int {
 	}
 	return count
 }
+
+func TestConcurrentWrite(t *testing.T) {
+	p := openTest(t)
+
+	slow, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- p.Write("/slow", slow) }()
+	w.Write(random(BlockSize * 2))
+
+	// A pending upload must not block other writers
+	bufs := map[string][]byte{}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < 8; i++ {
+		key, buf := "/c"+strconv.Itoa(i), random(rand.Intn(BlockSize*4))
+		bufs[key] = buf
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.WriteAll(key, buf); err != nil {
+				mu.Lock()
+				t.Error(err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := p.Delete("/c0"); err != nil {
+		t.Fatal(err)
+	}
+	delete(bufs, "/c0")
+
+	w.CloseWithError(fmt.Errorf("client gone"))
+	if err := <-done; err == nil {
+		t.Fatal("slow upload should fail")
+	}
+	if _, err := p.Info("/slow"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	for k, buf := range bufs {
+		buf2, err := p.ReadAll(k)
+		if err != nil || !bytes.Equal(buf, buf2) {
+			t.Fatal(k, err, len(buf), len(buf2))
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	p := openTest(t)
+
+	p.WriteAll("/site/index.html", random(BlockSize*2))
+	p.WriteAll("/site/old.html", []byte("old"))
+	before := p.Stat()
+
+	err := p.Batch(func(b *Batch) error {
+		b.WriteAll("/site/new.html", random(BlockSize*3))
+		b.Delete("/site/old.html")
+		b.Move("/site/missing.html", "/site/x.html", false)
+		return nil
+	})
+	if err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if after := p.Stat(); after != before {
+		t.Fatal(before, after)
+	}
+	if _, err := p.Info("/site/old.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write fails the batch even if f ignores it
+	err = p.Batch(func(b *Batch) error {
+		b.WriteAll("/ok", []byte("ok"))
+		b.WriteAll("/bad*name", []byte("bad"))
+		return nil
+	})
+	if err != ErrInvalidName {
+		t.Fatal(err)
+	}
+	if _, err := p.Info("/ok"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	if err := p.Batch(func(b *Batch) error {
+		b.Mkdir("/site/assets")
+		b.Delete("/site/old.html")
+		b.Move("/site/index.html", "/index.html", false)
+		b.UpdateTags("/index.html", func(m map[string]string) error {
+			m["published"] = "1"
+			return nil
+		})
+		return b.WriteAll("/site/new.html", random(BlockSize*3))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, _ := p.Info("/site")
+	if m.Size != BlockSize*3 || m.Count != 1 {
+		t.Fatal(m)
+	}
+	if m, _ := p.Info("/index.html"); m.Tags["published"] != "1" {
+		t.Fatal(m)
+	}
+	if m, _ := p.Info("/site/assets"); !m.IsDir {
+		t.Fatal(m)
+	}
+	if s := p.Stat(); s.Files != 2 || s.Size != BlockSize*5 {
+		t.Fatal(s)
+	}
+}
+
+func TestPrecondition(t *testing.T) {
+	p := openTest(t)
+
+	if err := p.If(IfNotExists()).WriteAll("/a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.If(IfNotExists()).WriteAll("/a", []byte("2")); err != ErrPreconditionFailed {
+		t.Fatal(err)
+	}
+	m, _ := p.Info("/a")
+	if err := p.If(IfGenerationMatch(m.Generation + 1)).Delete("/a"); err != ErrPreconditionFailed {
+		t.Fatal(err)
+	}
+	if err := p.If(IfCrc32Match(m.Crc32), IfETagMatch(m.ETag())).UpdateTags("/a", func(map[string]string) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m2, _ := p.Info("/a")
+	if m2.Generation <= m.Generation || m2.ETag() == m.ETag() {
+		t.Fatal(m, m2)
+	}
+	if err := p.If(IfGenerationMatch(m.Generation)).Move("/a", "/b", false); err != ErrPreconditionFailed {
+		t.Fatal(err)
+	}
+	if err := p.If(IfGenerationMatch(m2.Generation)).Move("/a", "/b", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	p := openTest(t)
+
+	p.WriteAll("/a/1", []byte("1"))
+	p.WriteAll("/b/1", []byte("1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := p.Watch(ctx, "/a/", 1)
+	if e := <-ch; e.Op != OpWrite || e.Name != "/a/1" || e.Seq != 1 {
+		t.Fatal(e)
+	}
+
+	go func() {
+		p.Move("/b/1", "/a/2", false)
+		p.Delete("/a/1")
+	}()
+	if e := <-ch; e.Op != OpMove || e.OldName != "/b/1" || e.Seq != 3 {
+		t.Fatal(e)
+	}
+	if e := <-ch; e.Op != OpDelete || e.Name != "/a/1" || e.Seq != 4 {
+		t.Fatal(e)
+	}
+
+	if err := p.TrimChanges(4); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	p.Changes("/", 0, func(e Event) error {
+		seqs = append(seqs, e.Seq)
+		return nil
+	})
+	if fmt.Sprint(seqs) != "[4]" {
+		t.Fatal(seqs)
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var committed []string
+	p := openTest(t, OpenOptions{Hooks: []Hook{
+		HookFuncs{
+			BeforeFunc: func(op *Operation) error {
+				if strings.HasPrefix(op.Name, "/private/") {
+					return fmt.Errorf("rejected")
+				}
+				if op.Op == OpWrite && bytes.HasPrefix(op.Head, []byte("<html>")) {
+					op.Tags = map[string]string{"content-type": "text/html"}
+				}
+				return nil
+			},
+			AfterFunc: func(op *Operation) error {
+				committed = append(committed, string(op.Op)+":"+op.Name)
+				return nil
+			},
+		},
+		HookFuncs{
+			Tx: true,
+			AfterFunc: func(op *Operation) error {
+				if op.Meta != nil && op.Meta.Size > 100 {
+					return fmt.Errorf("too large")
+				}
+				return nil
+			},
+		},
+	}})
+
+	if err := p.WriteAll("/private/a", []byte("1")); err == nil {
+		t.Fatal("should be rejected")
+	}
+	if err := p.WriteAll("/big", random(101)); err == nil {
+		t.Fatal("should be rejected")
+	}
+	if err := p.WriteAll("/index.html", []byte("<html></html>")); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := p.Info("/index.html"); m.Tags["content-type"] != "text/html" {
+		t.Fatal(m)
+	}
+	p.Delete("/index.html")
+	if fmt.Sprint(committed) != "[write:/index.html delete:/index.html]" {
+		t.Fatal(committed)
+	}
+
+	// Failing hooks after the commit do not stop the others nor fail the operation
+	var hookErrs []string
+	fail := HookFuncs{AfterFunc: func(op *Operation) error { return fmt.Errorf("failed %s", op.Name) }}
+	failOpen := HookFuncs{Tx: true, AfterFunc: func(op *Operation) error {
+		if op.Op == OpOpen {
+			return fmt.Errorf("failed %s", op.Name)
+		}
+		return nil
+	}}
+	p2 := openTest(t, OpenOptions{
+		Hooks: []Hook{fail, fail, failOpen},
+		HookError: func(op *Operation, err error) {
+			hookErrs = append(hookErrs, string(op.Op)+":"+err.Error())
+		},
+	})
+	if err := p2.WriteAll("/a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(hookErrs) != "[write:failed /a write:failed /a]" {
+		t.Fatal(hookErrs)
+	}
+	// Open has no transaction, all hooks run after it
+	hookErrs = nil
+	if buf, err := p2.ReadAll("/a"); err != nil || string(buf) != "1" {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(hookErrs) != "[open:failed /a open:failed /a open:failed /a]" {
+		t.Fatal(hookErrs)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	p := openTest(t)
+	p.WriteAll("/a", random(BlockSize*2))
+	before := p.Stat()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; ; i++ {
+			if i == 4 {
+				cancel()
+			}
+			if _, err := w.Write(random(BlockSize)); err != nil {
+				return
+			}
+		}
+	}()
+	if err := p.WriteContext(ctx, "/b", r); err != context.Canceled {
+		t.Fatal(err)
+	}
+	r.Close()
+	if after := p.Stat(); after != before {
+		t.Fatal(before, after)
+	}
+	if _, err := p.ListContext(ctx, "/"); err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	p, err := Open(filepath.Join(t.TempDir(), "testcompact"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, b := random(BlockSize*3), random(BlockSize*2+1)
+	p.WriteAll("/a", a)
+	p.WriteAll("/b", b)
+	p.Delete("/a")
+	if err := p.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(p.Stat().DataFile); fi.Size() != BlockSize*3 {
+		t.Fatal(fi.Size())
+	}
+	if buf, _ := p.ReadAll("/b"); !bytes.Equal(buf, b) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestImportExportDir(t *testing.T) {
+	p := openTest(t)
+
+	src, dst := t.TempDir(), t.TempDir()
+	mt := time.Unix(1600000000, 0)
+	files := map[string][]byte{"a.txt": random(10), "b/c.bin": random(BlockSize + 10), "b/d.tmp": nil}
+	for name, buf := range files {
+		fn := filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fn), 0777)
+		ioutil.WriteFile(fn, buf, 0666)
+		os.Chtimes(fn, mt, mt)
+	}
+
+	opts := DirOptions{Exclude: []string{"*.tmp"}, SkipUnchanged: true}
+	if err := p.ImportDir(context.Background(), src, "/site", opts); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := p.Info("/site/b/c.bin"); m.ModTime != mt.Unix() || m.Size != BlockSize+10 {
+		t.Fatal(m)
+	}
+	if _, err := p.Info("/site/b/d.tmp"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	skipped := 0
+	opts.Progress = func(pg Progress) {
+		if pg.Skipped {
+			skipped++
+		}
+	}
+	p.UpdateTags("/site/a.txt", func(m map[string]string) error {
+		m["k"] = "v"
+		return nil
+	})
+	if err := p.ImportDir(context.Background(), src, "/site", opts); err != nil || skipped != 2 {
+		t.Fatal(err, skipped)
+	}
+
+	opts.Tags = TagsManifest
+	if err := p.ExportDir(context.Background(), "/site", dst, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b/c.bin"} {
+		fn := filepath.Join(dst, filepath.FromSlash(name))
+		buf, _ := ioutil.ReadFile(fn)
+		fi, _ := os.Stat(fn)
+		if !bytes.Equal(buf, files[name]) || !fi.ModTime().Equal(mt) {
+			t.Fatal(name)
+		}
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dst, ManifestName)); !bytes.Contains(buf, []byte(`"k": "v"`)) {
+		t.Fatal(string(buf))
+	}
+}
+
+func TestArchive(t *testing.T) {
+	p := openTest(t)
+
+	mt := int64(1600000000)
+	big := random(BlockSize*2 + 10)
+	p.writeWithModTime(context.Background(), "/src/a.txt", strings.NewReader("hello"), mt, []string{"k", "v"})
+	p.writeWithModTime(context.Background(), "/src/b/c.bin", bytes.NewReader(big), mt, nil)
+	p.Mkdir("/src/empty")
+
+	check := func(prefix string) {
+		if m, err := p.Info(prefix + "/a.txt"); err != nil || m.ModTime != mt || m.Tags["k"] != "v" {
+			t.Fatal(prefix, m, err)
+		}
+		if buf, _ := p.ReadAll(prefix + "/b/c.bin"); !bytes.Equal(buf, big) {
+			t.Fatal(prefix, "data mismatch")
+		}
+		if m, err := p.Info(prefix + "/empty"); err != nil || !m.IsDir {
+			t.Fatal(prefix, m, err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := p.ExportTar(buf, "/src"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ImportTar(buf, "/tar"); err != nil {
+		t.Fatal(err)
+	}
+	check("/tar")
+
+	// Old style regular files are imported, links are refused
+	buf.Reset()
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "old.txt", Typeflag: tar.TypeReg, Size: 2, Format: tar.FormatUSTAR})
+	tw.Write([]byte("hi"))
+	tw.Close()
+	hdr := buf.Bytes()[:512]
+	hdr[156] = tar.TypeRegA
+	copy(hdr[148:156], "        ")
+	sum := 0
+	for _, c := range hdr {
+		sum += int(c)
+	}
+	copy(hdr[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	if err := p.ImportTar(buf, "/rega"); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := p.ReadAll("/rega/old.txt"); string(buf) != "hi" {
+		t.Fatal(string(buf))
+	}
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	tw.Close()
+	if err := p.ImportTar(buf, "/link"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	if err := p.ExportZip(buf, "/src"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ImportZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "/zip"); err != nil {
+		t.Fatal(err)
+	}
+	check("/zip")
+
+	// Archives of a directory made with "tar -C dir -cf x.tar ." start with "./"
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "./d/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "./d/a.txt", Typeflag: tar.TypeReg, Size: 2})
+	tw.Write([]byte("hi"))
+	tw.Close()
+	if err := p.ImportTar(buf, "/dot"); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := p.ReadAll("/dot/d/a.txt"); string(buf) != "hi" {
+		t.Fatal(string(buf))
+	}
+
+	if _, err := archiveKey("/x", "../y", false); err == nil {
+		t.Fatal("escaped prefix")
+	}
+	if _, err := archiveKey("/x", ".", false); err == nil {
+		t.Fatal("file at prefix")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	p := openTest(t)
+
+	srv := httptest.NewServer(&Handler{Package: p, Prefix: "/www", Writable: true})
+	defer srv.Close()
+
+	do := func(method, url string, body io.Reader, hdr ...string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+url, body)
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	data := random(BlockSize + 100)
+	resp := do("PUT", "/a/b.dat", bytes.NewReader(data), "Content-Type", "application/x-test")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(resp.Status)
+	}
+	etag := resp.Header.Get("ETag")
+
+	resp = do("GET", "/a/b.dat", nil, "Range", fmt.Sprintf("bytes=%d-", BlockSize-10))
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(buf, data[BlockSize-10:]) ||
+		resp.Header.Get("Content-Type") != "application/x-test" || resp.Header.Get("ETag") != etag {
+		t.Fatal(resp.Status, resp.Header)
+	}
+
+	if resp = do("GET", "/a/b.dat", nil, "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Fatal(resp.Status)
+	}
+	if resp = do("PUT", "/a/b.dat", strings.NewReader("x"), "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatal(resp.Status)
+	}
+	if resp = do("PUT", "/a/b.dat", strings.NewReader("x"), "If-Match", `"nope"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatal(resp.Status)
+	}
+	if resp = do("PUT", "/a/b.dat", bytes.NewReader(data), "If-Match", `"nope", W/`+etag); resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.Status)
+	}
+	if resp = do("PUT", "/a/b.dat", bytes.NewReader(data), "If-None-Match", `"nope", "other"`); resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.Status)
+	}
+	if resp = do("PUT", "/a/b.dat", bytes.NewReader(data), "If-None-Match", `"nope", `+resp.Header.Get("ETag")); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatal(resp.Status)
+	}
+
+	resp = do("GET", "/a/", nil)
+	buf, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Contains(buf, []byte(`href="b.dat"`)) {
+		t.Fatal(string(buf))
+	}
+
+	if resp = do("DELETE", "/a/b.dat", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.Status)
+	}
+	if resp = do("GET", "/a/b.dat", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal(resp.Status)
+	}
+
+	// Requests cannot escape the prefix
+	p.WriteAll("/secret/key", []byte("secret"))
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		resp := do(method, "/../secret/key", strings.NewReader("x"))
+		if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+			t.Fatal(method, resp.Status)
+		}
+	}
+	if buf, _ := p.ReadAll("/secret/key"); string(buf) != "secret" {
+		t.Fatal(string(buf))
+	}
+}
+
+func TestS3Gateway(t *testing.T) {
+	p := openTest(t)
+
+	srv := httptest.NewServer(&S3Gateway{Package: p})
+	defer srv.Close()
+
+	do := func(method, url string, body io.Reader, hdr ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+url, body)
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(buf)
+	}
+
+	if resp, _ := do("PUT", "/bk/a.txt", strings.NewReader("x")); resp.StatusCode != http.StatusNotFound {
+		t.Fatal(resp.Status)
+	}
+	if resp, _ := do("PUT", "/bk", nil); resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	if _, body := do("GET", "/", nil); !strings.Contains(body, "<Name>bk</Name>") || strings.Contains(body, "1970") {
+		t.Fatal(body)
+	}
+
+	data := random(BlockSize + 10)
+	do("PUT", "/bk/dir/a.bin", bytes.NewReader(data), "X-Amz-Meta-Owner", "me")
+	do("PUT", "/bk/dir/sub/b.txt", strings.NewReader("b"))
+	do("PUT", "/bk/c.txt", strings.NewReader("5\r\nhello\r\n0;chunk-signature=x\r\n\r\n"),
+		"X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	if buf, _ := p.ReadAll("/bk/c.txt"); string(buf) != "hello" {
+		t.Fatal(string(buf))
+	}
+
+	resp, body := do("GET", "/bk/dir/a.bin", nil, "Range", "bytes=10-19")
+	if resp.StatusCode != http.StatusPartialContent || body != string(data[10:20]) || resp.Header.Get("X-Amz-Meta-Owner") != "me" {
+		t.Fatal(resp.Status, resp.Header)
+	}
+	if resp, _ := do("HEAD", "/bk/nope", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal(resp.Status)
+	}
+	for _, method := range []string{"HEAD", "DELETE"} {
+		if resp, _ := do(method, "/bk/c.txt/", nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatal(method, resp.Status)
+		}
+	}
+	if _, err := p.Info("/bk/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, body = do("GET", "/bk?list-type=2&delimiter=/&prefix=dir/", nil)
+	if !strings.Contains(body, "<Key>dir/a.bin</Key>") || !strings.Contains(body, "<Prefix>dir/sub/</Prefix>") {
+		t.Fatal(body)
+	}
+	_, body = do("GET", "/bk?list-type=2&max-keys=2", nil)
+	if !strings.Contains(body, "<IsTruncated>true</IsTruncated>") || !strings.Contains(body, "<NextContinuationToken>dir/a.bin</NextContinuationToken>") {
+		t.Fatal(body)
+	}
+	_, body = do("GET", "/bk?list-type=2&max-keys=0", nil)
+	if !strings.Contains(body, "<IsTruncated>false</IsTruncated>") || strings.Contains(body, "<Key>") {
+		t.Fatal(body)
+	}
+	_, body = do("GET", "/bk?list-type=2&continuation-token=dir/a.bin", nil)
+	if !strings.Contains(body, "<Key>dir/sub/b.txt</Key>") || strings.Contains(body, "<Key>c.txt</Key>") {
+		t.Fatal(body)
+	}
+
+	if resp, body := do("PUT", "/bk/copy.bin", nil, "X-Amz-Copy-Source", "/bk/dir/a.bin"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "CopyObjectResult") {
+		t.Fatal(resp.Status, body)
+	}
+	if m, _ := p.Info("/bk/copy.bin"); m.Size != int64(len(data)) || m.Tags["owner"] != "me" {
+		t.Fatal(m)
+	}
+
+	_, body = do("POST", "/bk/big?uploads", nil, "X-Amz-Meta-K", "v")
+	id := body[strings.Index(body, "<UploadId>")+10 : strings.Index(body, "</UploadId>")]
+	var complete strings.Builder
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i := 1; i <= 3; i++ {
+		resp, _ := do("PUT", fmt.Sprintf("/bk/big?partNumber=%d&uploadId=%s", i, id), bytes.NewReader(data))
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i, resp.Header.Get("ETag"))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	if _, body := do("GET", "/bk/big?uploadId="+id, nil); strings.Count(body, "<Part>") != 3 {
+		t.Fatal(body)
+	}
+	if resp, body := do("POST", "/bk/big?uploadId="+id, strings.NewReader(complete.String())); resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status, body)
+	}
+	if buf, _ := p.ReadAll("/bk/big"); !bytes.Equal(buf, bytes.Repeat(data, 3)) {
+		t.Fatal("multipart data mismatch")
+	}
+	if m, _ := p.Info("/bk/big"); m.Tags["k"] != "v" {
+		t.Fatal(m)
+	}
+	if uploads, err := p.Uploads("/"); len(uploads) != 0 {
+		t.Fatal(uploads, err)
+	}
+
+	if resp, _ := do("DELETE", "/bk", nil); resp.StatusCode != http.StatusConflict {
+		t.Fatal(resp.Status)
+	}
+	for _, key := range []string{"dir/a.bin", "dir/sub/b.txt", "c.txt", "copy.bin", "big", "nope"} {
+		if resp, _ := do("DELETE", "/bk/"+key, nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatal(key, resp.Status)
+		}
+	}
+	if resp, _ := do("DELETE", "/bk", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.Status)
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	p := openTest(t)
+
+	srv := httptest.NewServer(NewDAVHandler(p, "/dav"))
+	defer srv.Close()
+	sub := httptest.NewServer(NewDAVHandler(p, "/dav/sub"))
+	defer sub.Close()
+
+	do := func(srv *httptest.Server, method, url, body string, hdr ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+url, strings.NewReader(body))
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(buf)
+	}
+
+	if resp, _ := do(srv, "PUT", "/sub/a.txt", "x"); resp.StatusCode != http.StatusNotFound {
+		t.Fatal(resp.Status)
+	}
+	if resp, _ := do(srv, "MKCOL", "/sub", ""); resp.StatusCode != http.StatusCreated {
+		t.Fatal(resp.Status)
+	}
+	if resp, _ := do(srv, "PUT", "/sub/a.txt", "hello"); resp.StatusCode != http.StatusCreated {
+		t.Fatal(resp.Status)
+	}
+	if _, body := do(sub, "GET", "/a.txt", ""); body != "hello" {
+		t.Fatal(body)
+	}
+
+	resp, body := do(srv, "PROPPATCH", "/sub/a.txt", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:test"><D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`)
+	if resp.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "200 OK") {
+		t.Fatal(resp.Status, body)
+	}
+	if m, _ := p.Info("/dav/sub/a.txt"); m.Tags["dav:urn:test color"] != "red" {
+		t.Fatal(m)
+	}
+	do(srv, "PUT", "/sub/a.txt", "world")
+	_, body = do(srv, "PROPFIND", "/sub/", "", "Depth", "1")
+	if !strings.Contains(body, "a.txt") || !strings.Contains(body, ">red<") {
+		t.Fatal(body)
+	}
+
+	// A lock taken through one handler is seen by the other
+	resp, _ = do(srv, "LOCK", "/sub/a.txt", `<?xml version="1.0"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)
+	token := resp.Header.Get("Lock-Token")
+	if resp.StatusCode != http.StatusOK || token == "" {
+		t.Fatal(resp.Status)
+	}
+	if resp, _ := do(sub, "PUT", "/a.txt", "other"); resp.StatusCode != http.StatusLocked {
+		t.Fatal(resp.Status)
+	}
+	do(srv, "UNLOCK", "/sub/a.txt", "", "Lock-Token", token)
+
+	if resp, _ := do(srv, "MOVE", "/sub", "", "Destination", srv.URL+"/moved"); resp.StatusCode != http.StatusCreated {
+		t.Fatal(resp.Status)
+	}
+	if buf, _ := p.ReadAll("/dav/moved/a.txt"); string(buf) != "world" {
+		t.Fatal(string(buf))
+	}
+	if _, err := p.Info("/dav/sub"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if resp, _ := do(srv, "DELETE", "/moved", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.Status)
+	}
+	if _, err := p.Info("/dav/moved"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	// Files changed by others while being written are not overwritten
+	fs := &DAVFileSystem{Package: p, Prefix: "/dav"}
+	f, err := fs.OpenFile(context.Background(), "/b.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("mine"))
+	p.WriteAll("/dav/b.txt", []byte("theirs"))
+	if err := f.Close(); err != ErrPreconditionFailed {
+		t.Fatal(err)
+	}
+	if buf, _ := p.ReadAll("/dav/b.txt"); string(buf) != "theirs" {
+		t.Fatal(string(buf))
+	}
+}
+
+// openTest opens a package in memory which is closed at the end of the test.
+func openTest(t *testing.T, opts ...OpenOptions) *Package {
+	p, err := OpenMemory(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func usedBlocks(p *Package) (n int64) {
+	p.db.View(func(tx *bbolt.Tx) error {
+		n = loadBitmap(tx).Count()
+		return nil
+	})
+	return n
+}
+
+func TestUpload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testupload")
+	p, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := random(BlockSize*2), random(100)
+	if crc32Combine(crc32.ChecksumIEEE(a), crc32.ChecksumIEEE(b), int64(len(b))) != crc32.ChecksumIEEE(append(a, b...)) {
+		t.Fatal("crc32Combine")
+	}
+
+	id, err := p.InitUpload("/up/a", "k", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.UploadPart(id, 2, bytes.NewReader(b))
+	p.UploadPart(id, 3, bytes.NewReader(b))
+
+	// Parts survive reopening
+	p.Close()
+	if p, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.UploadPart(id, 1, bytes.NewReader(a))
+	if parts, err := p.ListParts(id); err != nil || len(parts) != 3 || parts[0].N != 1 || parts[0].Size != BlockSize*2 {
+		t.Fatal(parts, err)
+	}
+	blocks := usedBlocks(p)
+	if err := p.CompleteUpload(id, []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := p.Info("/up/a")
+	if buf, _ := p.ReadAll("/up/a"); !bytes.Equal(buf, append(a, b...)) || m.Crc32 != crc32.ChecksumIEEE(buf) || m.Tags["k"] != "v" {
+		t.Fatal(m)
+	}
+	if usedBlocks(p) != blocks { // part 3 is dropped, but it shares a block with part 2
+		t.Fatal(usedBlocks(p), blocks)
+	}
+	if err := p.UploadPart(id, 4, bytes.NewReader(b)); err != ErrNoSuchUpload {
+		t.Fatal(err)
+	}
+
+	// Unaligned parts are copied
+	id, _ = p.InitUpload("/up/b")
+	p.UploadPart(id, 1, bytes.NewReader(b))
+	p.UploadPart(id, 2, bytes.NewReader(a))
+	if err := p.CompleteUpload(id, []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := p.ReadAll("/up/b"); !bytes.Equal(buf, append(b, a...)) {
+		t.Fatal("unaligned data mismatch")
+	}
+	if usedBlocks(p) != blocks+2 {
+		t.Fatal(usedBlocks(p), blocks)
+	}
+
+	id, _ = p.InitUpload("/up/c")
+	p.UploadPart(id, 1, bytes.NewReader(a))
+	p.AbortUpload(id)
+	id, _ = p.InitUpload("/up/d")
+	p.UploadPart(id, 1, bytes.NewReader(a))
+	if n, err := p.CleanUploads(time.Hour); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := p.CleanUploads(-time.Second); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if usedBlocks(p) != blocks+2 {
+		t.Fatal(usedBlocks(p), blocks)
+	}
+}
+
+func TestBlockStore(t *testing.T) {
+	segs, err := OpenSegmentStore(filepath.Join(t.TempDir(), "segs"), BlockSize, BlockSize*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]BlockStore{"mem": NewMemStore(BlockSize), "segment": segs} {
+		p, err := OpenMemory(OpenOptions{Store: store})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files := map[string][]byte{}
+		for i := 0; i < 6; i++ {
+			key := fmt.Sprintf("/s/%d", i)
+			files[key] = random(BlockSize*i + i*100)
+			if err := p.WriteAll(key, files[key]); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		for i := 0; i < 6; i += 2 {
+			key := fmt.Sprintf("/s/%d", i)
+			p.Delete(key)
+			delete(files, key)
+		}
+		if err := p.Compact(context.Background()); err != nil {
+			t.Fatal(name, err)
+		}
+		for key, buf := range files {
+			if got, err := p.ReadAll(key); err != nil || !bytes.Equal(got, buf) {
+				t.Fatal(name, key, err)
+			}
+		}
+		if size, _ := store.Size(); size != usedBlocks(p)*BlockSize {
+			t.Fatal(name, size, usedBlocks(p))
+		}
+		p.Close()
+	}
+}
+
+func TestMemory(t *testing.T) {
+	p, err := OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	files := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/m/%d", i)
+		files[key] = random(i * BlockSize / 3)
+		if err := p.WriteAll(key, files[key], "i", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Delete("/m/4")
+	delete(files, "/m/4")
+	if s := p.Stat(); s.Files != 9 || s.IndexFile != "" {
+		t.Fatal(s)
+	}
+
+	opts := []OpenOptions{{BlockSize: 4096}}
+	openTest(t, opts...)
+	if opts[0].Store != nil {
+		t.Fatal("options modified")
+	}
+
+	path := filepath.Join(t.TempDir(), "persisted")
+	if err := p.Persist(path); err != nil {
+		t.Fatal(err)
+	}
+	p2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Close()
+	if s, s2 := p.Stat(), p2.Stat(); s.Files != s2.Files || s.Size != s2.Size {
+		t.Fatal(s, s2)
+	}
+	for key, buf := range files {
+		if got, err := p2.ReadAll(key); err != nil || !bytes.Equal(got, buf) {
+			t.Fatal(key, err)
+		}
+		if m, _ := p2.Info(key); m.Tags["i"] != key[3:] {
+			t.Fatal(m)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "testseg")
+	p, err := Open(path, OpenOptions{SegmentSize: BlockSize * 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := p.WriteAll(fmt.Sprintf("/s/%d", i), random(BlockSize*2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "testseg.*.data.*"))
+	if len(segs) != 4 {
+		t.Fatal(segs)
+	}
+	buf := random(BlockSize + 1)
+	p.WriteAll("/s/x", buf)
+	for i := 0; i < 4; i++ {
+		p.Delete(fmt.Sprintf("/s/%d", i))
+	}
+	if err := p.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if segs, _ = filepath.Glob(filepath.Join(dir, "testseg.*.data.*")); len(segs) != 1 {
+		t.Fatal(segs)
+	}
+
+	if _, err := Open(path, OpenOptions{SegmentSize: BlockSize}); err == nil {
+		t.Fatal("segment size changed")
+	}
+	p, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := p.ReadAll("/s/x"); !bytes.Equal(got, buf) {
+		t.Fatal("segmented data")
+	}
+	p.Close()
+
+	// Free middle segments can be dropped, missing ones holding data are refused
+	path = filepath.Join(dir, "testgap")
+	if p, err = Open(path, OpenOptions{SegmentSize: BlockSize * 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		p.WriteAll(fmt.Sprintf("/s/%d", i), random(BlockSize*2))
+	}
+	p.Delete("/s/1")
+	if err := p.DropSegment(2); !errors.Is(err, ErrSegmentInUse) {
+		t.Fatal(err)
+	}
+	size := p.Stat().DataSize
+	if err := p.DropSegment(1); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if segs, _ = filepath.Glob(filepath.Join(dir, "testgap.*.data.*")); len(segs) != 3 {
+		t.Fatal(segs)
+	}
+	if p, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if p.Stat().DataSize != size {
+		t.Fatal(p.Stat().DataSize, size)
+	}
+	buf = random(BlockSize * 2)
+	p.WriteAll("/s/1", buf)
+	for i := 0; i < 4; i++ {
+		if _, err := p.ReadAll(fmt.Sprintf("/s/%d", i)); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if got, _ := p.ReadAll("/s/1"); !bytes.Equal(got, buf) {
+		t.Fatal("reused segment")
+	}
+	p.Close()
+	os.Remove(segs[1])
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatal(err)
+	}
+
+	// Single file packages stay single file
+	path = filepath.Join(dir, "testsingle")
+	p, _ = Open(path)
+	p.WriteAll("/a", buf)
+	p.Close()
+	p, err = Open(path, OpenOptions{SegmentSize: BlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if got, _ := p.ReadAll("/a"); !bytes.Equal(got, buf) || strings.HasSuffix(p.Stat().DataFile, "*") {
+		t.Fatal("single data file", p.Stat().DataFile)
+	}
+}
+
+func TestBlockSizeOption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testbs")
+	p, err := Open(path, OpenOptions{BlockSize: 4096, SmallThreshold: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, big := random(99), random(4096*2+10)
+	p.WriteAll("/small", small)
+	p.WriteAll("/big", big)
+	if n := usedBlocks(p); n != 3 {
+		t.Fatal(n)
+	}
+	aligned := random(4096 * 2)
+	p.WriteAll("/append", aligned)
+	if err := p.Append("/append", bytes.NewReader(small)); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	if _, err := Open(path, OpenOptions{BlockSize: 8192}); err == nil {
+		t.Fatal("block size changed")
+	}
+	if _, err := Open(path, OpenOptions{Store: NewMemStore(BlockSize)}); err == nil {
+		t.Fatal("store block size")
+	}
+	p, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Stat().BlockSize != 4096 {
+		t.Fatal(p.Stat())
+	}
+	for key, buf := range map[string][]byte{"/small": small, "/big": big, "/append": append(aligned, small...)} {
+		if got, err := p.ReadAll(key); err != nil || !bytes.Equal(got, buf) {
+			t.Fatal(key, err)
+		}
+	}
+	if m, _ := p.Info("/small"); len(m.SmallData) != 99 {
+		t.Fatal(m)
+	}
+}
+
+func TestPacking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testpack")
+	p, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{}
+	for i := 0; i < 24; i++ {
+		key := fmt.Sprintf("/p/%02d", i)
+		files[key] = random(10 * 1024)
+		if err := p.WriteAll(key, files[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := usedBlocks(p); n != 2 { // 12 files of 5 slots per block
+		t.Fatal(n)
+	}
+	files["/p/big"] = random(BlockSize + 3000)
+	p.WriteAll("/p/big", files["/p/big"])
+	if n := usedBlocks(p); n != 3 {
+		t.Fatal(n)
+	}
+	if m, _ := p.Info("/p/big"); m.Tail == nil || m.Tail.Len != 3000 {
+		t.Fatal(m.Tail)
+	}
+
+	// Leave both shared blocks mostly empty, compaction packs them into one
+	for i := 0; i < 24; i++ {
+		if key := fmt.Sprintf("/p/%02d", i); i%4 != 0 {
+			p.Delete(key)
+			delete(files, key)
+		}
+	}
+	if n := usedBlocks(p); n != 3 {
+		t.Fatal(n)
+	}
+	if err := p.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := usedBlocks(p); n != 2 {
+		t.Fatal(n)
+	}
+	if size, _ := p.store.Size(); size != 2*BlockSize {
+		t.Fatal(size)
+	}
+	p.Close()
+
+	if p, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for key, buf := range files {
+		if got, err := p.ReadAll(key); err != nil || !bytes.Equal(got, buf) {
+			t.Fatal(key, err)
+		}
+	}
+	p.WriteAll("/p/more", random(4096))
+	if n := usedBlocks(p); n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestExtents(t *testing.T) {
+	var b Blocks
+	for i := uint32(0); i < 1000; i++ {
+		b.Append(i + 100)
+	}
+	b.Append(5)
+	b.Append(6)
+	if b.String() != "[#100+1000,#5+2]" || b.Last() != 6 || len(b) != 5 {
+		t.Fatal(b, b.Last(), len(b))
+	}
+
+	path := filepath.Join(t.TempDir(), "testext")
+	p, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	buf := random(BlockSize*5 + 10)
+	p.WriteAll("/e", buf)
+	m, _ := p.Info("/e")
+	if m.Positions.String() != "[#0+5]" {
+		t.Fatal(m.Positions)
+	}
+
+	// Metas with the old block list are read and rewritten as runs
+	var legacy []byte
+	m.Positions.ForEach(func(v uint32) error {
+		legacy = putUvarint(legacy, uint64(v))
+		return nil
+	})
+	old, _ := json.Marshal(m)
+	old = bytes.Replace(old, []byte(`"ex":`), []byte(`"pos":`), 1)
+	old = bytes.Replace(old, []byte(base64.StdEncoding.EncodeToString(m.Positions)), []byte(base64.StdEncoding.EncodeToString(legacy)), 1)
+	p.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(trunkBucket).Put([]byte("/e"), old)
+	})
+	if got, err := p.ReadAll("/e"); err != nil || !bytes.Equal(got, buf) {
+		t.Fatal(err)
+	}
+	if err := p.UpdateTags("/e", func(map[string]string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	p.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(trunkBucket).Get([]byte("/e")); v[0] != metaVersion {
+			t.Fatal(string(v))
+		}
+		return nil
+	})
+}
+
+func TestMetaEncoding(t *testing.T) {
+	m := Meta{Name: "/a", Size: BlockSize + 10, CreateTime: 1, ModTime: -2, Crc32: 0xdeadbeef, Generation: 7,
+		Tags: map[string]string{"k": "v", "": "x"}, Tail: &Extent{Block: 3, Off: 4096, Len: 10}}
+	m.Positions.Append(9)
+	got, err := unmarshalMeta(m.marshal(), BlockSize)
+	if err != nil || got.String() != m.String() || !bytes.Equal(got.Positions, m.Positions) || *got.Tail != *m.Tail {
+		t.Fatal(got, err)
+	}
+	for i := 0; i < len(m.marshal()); i++ {
+		if _, err := unmarshalMeta(m.marshal()[:i], BlockSize); !errors.Is(err, ErrCorruptMeta) {
+			t.Fatal(i, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "testcodec")
+	p, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for i := 0; i < 5; i++ {
+		p.WriteAll(fmt.Sprintf("/c/%d", i), random(i*1000), "i", strconv.Itoa(i))
+	}
+	// Turn metas into legacy JSON
+	p.db.Update(func(tx *bbolt.Tx) error {
+		bk := tx.Bucket(trunkBucket)
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("/c/%d", i))
+			m, _ := unmarshalMeta(bk.Get(key), p.blockSize)
+			buf, _ := json.Marshal(m)
+			bk.Put(key, buf)
+		}
+		return nil
+	})
+	before, _ := p.List("/c")
+	if n, err := p.MigrateMetas(context.Background()); n != 5 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := p.MigrateMetas(context.Background()); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	after, _ := p.List("/c")
+	if fmt.Sprint(before) != fmt.Sprint(after) || len(after) != 5 {
+		t.Fatal(before, after)
+	}
+
+	// Corrupt entries are reported instead of turning into empty metas
+	p.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(trunkBucket).Put([]byte("/c/2"), []byte{metaVersion, 0xff})
+	})
+	if _, err := p.Info("/c/2"); !errors.Is(err, ErrCorruptMeta) {
+		t.Fatal(err)
+	}
+	if _, err := p.List("/c"); !errors.Is(err, ErrCorruptMeta) {
+		t.Fatal(err)
+	}
+
+	// Malformed runs and tails fail instead of panicking readers
+	bad := []Meta{
+		{Name: "/c/3", Size: BlockSize, Positions: Blocks{1, 0}},
+		{Name: "/c/3", Size: BlockSize, Positions: Blocks{0xff, 0xff, 0xff, 0xff, 0x0f, 2}},
+		{Name: "/c/3", Size: BlockSize, Positions: Blocks{1}},
+		{Name: "/c/3", Size: 10, Tail: &Extent{Off: BlockSize - 5, Len: 10}},
+		{Name: "/c/3", Size: 2 * BlockSize, Tail: &Extent{Len: 10}},
+		{Name: "/c/3", Size: 3 * BlockSize, Positions: Blocks{1, 1}},
+	}
+	for i, m := range bad {
+		p.db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket(trunkBucket).Put([]byte(m.Name), m.marshal())
+		})
+		if _, err := p.Info(m.Name); !errors.Is(err, ErrCorruptMeta) {
+			t.Fatal(i, err)
+		}
+		if _, err := p.ReadAll(m.Name); !errors.Is(err, ErrCorruptMeta) {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+func runs(m Meta) (n int, first uint32) {
+	m.Positions.ForEachRun(func(start, _ uint32) error {
+		if n++; n == 1 {
+			first = start
+		}
+		return nil
+	})
+	return n, first
+}
+
+func TestAllocator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testalloc")
+	p, err := Open(path, OpenOptions{BlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		p.WriteAll(fmt.Sprintf("/a/%d", i), random(4096*4))
+	}
+	p.Delete("/a/1")
+	p.Delete("/a/3")
+
+	// Holes of 4 blocks are too small for a file of 6
+	big := random(4096 * 6)
+	p.WriteAll("/big", big)
+	if m, _ := p.Info("/big"); fmt.Sprint(runs(m)) != "1 40" {
+		t.Fatal(m.Positions)
+	}
+	p.WriteAll("/fit", random(4096*4))
+	if m, _ := p.Info("/fit"); fmt.Sprint(runs(m)) != "1 4" {
+		t.Fatal(m.Positions)
+	}
+
+	// Concurrent writers of unknown sizes do not interleave their blocks
+	var wg sync.WaitGroup
+	var pws []*io.PipeWriter
+	for i := 0; i < 2; i++ {
+		pr, pw := io.Pipe()
+		pws = append(pws, pw)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := p.Write(fmt.Sprintf("/pipe/%d", i), pr); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		for _, pw := range pws {
+			pw.Write(random(4096))
+		}
+	}
+	for _, pw := range pws {
+		pw.Close()
+	}
+	wg.Wait()
+	for i := 0; i < 2; i++ {
+		if m, _ := p.Info(fmt.Sprintf("/pipe/%d", i)); m.Size != 4096*8 || fmt.Sprint(runs(m))[:2] != "1 " {
+			t.Fatal(m.Size, m.Positions)
+		}
+	}
+	used := usedBlocks(p)
+
+	// Pages of the free bitmap are rewritten only when touched
+	p.db.Update(func(tx *bbolt.Tx) error {
+		m := &bitmapPages{bk: tx.Bucket(freeBucket)}
+		m.Set(bitmapPage*8*2 + 5)
+		m.flush()
+		if tx.Bucket(freeBucket).Get(uint32ToBytes(1)) != nil || len(tx.Bucket(freeBucket).Get(uint32ToBytes(2))) != 1 {
+			t.Fatal("pages")
+		}
+		if n := loadBitmap(tx).Count(); n != used+1 {
+			t.Fatal(n)
+		}
+		m.Free(bitmapPage*8*2 + 5)
+		m.flush()
+		if tx.Bucket(freeBucket).Get(uint32ToBytes(2)) != nil {
+			t.Fatal("empty page")
+		}
+		return nil
+	})
+
+	// Older packages keep the whole bitmap under freeKey
+	p.db.Update(func(tx *bbolt.Tx) error {
+		tx.Bucket(trunkBucket).Put(freeKey, loadBitmap(tx))
+		tx.DeleteBucket(freeBucket)
+		_, err := tx.CreateBucket(freeBucket)
+		return err
+	})
+	p.Close()
+	p, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if n := usedBlocks(p); n != used {
+		t.Fatal(n, used)
+	}
+	p.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(trunkBucket).Get(freeKey) != nil {
+			t.Fatal("legacy bitmap")
+		}
+		return nil
+	})
+	if buf, _ := p.ReadAll("/big"); !bytes.Equal(buf, big) {
+		t.Fatal("big")
+	}
+}
+
+func TestDefragment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testdefrag")
+	p, err := Open(path, OpenOptions{BlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Appends interleaved with other writes scatter /f
+	var data []byte
+	for i := 0; i < 3; i++ {
+		buf := random(4096 * 2)
+		data = append(data, buf...)
+		if i == 0 {
+			p.WriteAll("/f", buf)
+		} else if err := p.Append("/f", bytes.NewReader(buf)); err != nil {
+			t.Fatal(err)
+		}
+		p.WriteAll(fmt.Sprintf("/x/%d", i), random(4096*(i+1)))
+	}
+	p.Delete("/x/1")
+	p.WriteAll("/small", random(100))
+
+	r, err := p.Fragmentation("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Files) != 3 || r.Files[0] != (FileFragments{"/f", 6, 3}) {
+		t.Fatal(r.Files)
+	}
+	if r.UsedBlocks != 10 || r.FreeBlocks != 2 || r.Holes[1] != 1 {
+		t.Fatal(r)
+	}
+
+	if err := p.Defragment(context.Background(), []string{"/f", "/x/0"}); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := p.Fragmentation("/"); r.Files[0] != (FileFragments{"/f", 6, 1}) {
+		t.Fatal(r.Files)
+	}
+	if buf, _ := p.ReadAll("/f"); !bytes.Equal(buf, data) {
+		t.Fatal("data")
+	}
+	if err := p.Defragment(context.Background(), []string{"/none"}); !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+}
+
+// triggerStore calls trigger, if set, once before reading a block.
+type triggerStore struct {
+	BlockStore
+	mu      sync.Mutex
+	trigger func()
+}
+
+func (s *triggerStore) ReadBlock(b uint32, off int64, p []byte) (int, error) {
+	s.mu.Lock()
+	f := s.trigger
+	s.trigger = nil
+	s.mu.Unlock()
+	if f != nil {
+		f()
+	}
+	return s.BlockStore.ReadBlock(b, off, p)
+}
+
+func TestDefragmentConflict(t *testing.T) {
+	store := &triggerStore{BlockStore: NewMemStore(4096)}
+	p := openTest(t, OpenOptions{Store: store})
+	for i := 0; i < 3; i++ {
+		if i == 0 {
+			p.WriteAll("/f", random(4096*2))
+		} else {
+			p.Append("/f", bytes.NewReader(random(4096*2)))
+		}
+		p.WriteAll(fmt.Sprintf("/x/%d", i), random(4096))
+	}
+
+	// /f is rewritten while being copied, other writes try to reuse its blocks
+	data := random(4096 * 3)
+	done := make(chan error, 1)
+	store.trigger = func() {
+		go func() {
+			err := p.WriteAll("/f", data)
+			for i := 0; i < 6 && err == nil; i++ {
+				err = p.WriteAll(fmt.Sprintf("/g/%d", i), random(4096))
+			}
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := p.Defragment(context.Background(), []string{"/f"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := p.ReadAll("/f"); !bytes.Equal(buf, data) {
+		t.Fatal("data")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	store := &triggerStore{BlockStore: NewMemStore(4096)}
+	p := openTest(t, OpenOptions{Store: store})
+	data := random(4096 * 3)
+	p.WriteAll("/f", data, "v", "1")
+
+	// /f is rewritten while being copied, other writes try to reuse its blocks
+	store.trigger = func() {
+		err := p.WriteAll("/f", random(4096*3), "v", "2")
+		for i := 0; i < 6 && err == nil; i++ {
+			err = p.WriteAll(fmt.Sprintf("/g/%d", i), random(4096))
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if err := p.Copy("/f", "/c", false); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := p.Info("/c")
+	if buf, _ := p.ReadAll("/c"); !bytes.Equal(buf, data) || m.Tags["v"] != "1" {
+		t.Fatal("copy", m.Tags)
+	}
+	if err := p.Copy("/f", "/c", false); err != ErrPreconditionFailed {
+		t.Fatal(err)
+	}
+	if err := p.Copy("/g", "/c", true); err != ErrIsDirectory {
+		t.Fatal(err)
+	}
+}
+
+func TestPunchHoles(t *testing.T) {
+	dir := t.TempDir()
+	p, err := Open(filepath.Join(dir, "testpunch"), OpenOptions{BlockSize: 4096, PunchHoles: true})
+	if err == ErrPunchUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := random(4096*16), random(4096*16)
+	p.WriteAll("/a", a)
+	p.WriteAll("/b", b)
+	before := p.Stat()
+	if before.DataSize != 4096*32 || before.DataAlloc < 4096*32 {
+		t.Fatal(before.DataSize, before.DataAlloc)
+	}
+	p.Delete("/a")
+	after := p.Stat()
+	if after.DataSize != before.DataSize || after.DataAlloc > before.DataAlloc-4096*16 {
+		t.Fatal(after.DataSize, after.DataAlloc)
+	}
+	if buf, _ := p.ReadAll("/b"); !bytes.Equal(buf, b) {
+		t.Fatal("b")
+	}
+	p.WriteAll("/a", a) // back into the hole
+	if buf, _ := p.ReadAll("/a"); !bytes.Equal(buf, a) {
+		t.Fatal("a")
+	}
+	p.Close()
+
+	// Blocks freed without punching are reclaimed by a sweep
+	for _, o := range []OpenOptions{{BlockSize: 4096}, {Store: NewMemStore(4096)}} {
+		p, err := Open(filepath.Join(dir, "testreclaim"), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.WriteAll("/a", a)
+		p.WriteAll("/b", b)
+		p.Delete("/a")
+		before := p.Stat().DataAlloc
+		if err := p.ReclaimFreeSpace(); err != nil {
+			t.Fatal(err)
+		}
+		if after := p.Stat().DataAlloc; after > before-4096*16 {
+			t.Fatal(before, after)
+		}
+		if buf, _ := p.ReadAll("/b"); !bytes.Equal(buf, b) {
+			t.Fatal("b")
+		}
+		p.Close()
+		os.Remove(filepath.Join(dir, "testreclaim.index"))
+	}
+}
+
+// faultStore is a MemStore losing writes not synced yet when it crashes.
+type faultStore struct {
+	*MemStore
+	mu      sync.Mutex
+	durable *MemStore
+	pending []faultWrite
+	syncs   int
+	delay   time.Duration
+}
+
+type faultWrite struct {
+	b   uint32
+	off int64
+	p   []byte
+}
+
+func newFaultStore(blockSize int64) *faultStore {
+	return &faultStore{MemStore: NewMemStore(blockSize), durable: NewMemStore(blockSize)}
+}
+
+func (s *faultStore) WriteBlock(b uint32, off int64, p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, faultWrite{b, off, append([]byte(nil), p...)})
+	return s.MemStore.WriteBlock(b, off, p)
+}
+
+func (s *faultStore) Truncate(n int64) error {
+	s.durable.Truncate(n)
+	return s.MemStore.Truncate(n)
+}
+
+func (s *faultStore) Sync() error {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.pending {
+		s.durable.WriteBlock(w.b, w.off, w.p)
+	}
+	s.pending, s.syncs = nil, s.syncs+1
+	return nil
+}
+
+// crash returns what is left on disk after a power failure, every write not
+// synced is lost, kept or torn as chosen by rnd, which returns -1 to drop a
+// write or the number of bytes to keep.
+func (s *faultStore) crash(rnd func(n int) int) *MemStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.pending {
+		if n := rnd(len(w.p)); n >= 0 {
+			s.durable.WriteBlock(w.b, w.off, w.p[:n])
+		}
+	}
+	s.pending = nil
+	return s.durable
+}
+
+// corrupted reopens the package at path on store and returns the files whose
+// contents do not match their CRC32.
+func corrupted(t *testing.T, path string, store BlockStore) (bad []string) {
+	p, err := Open(path, OpenOptions{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.ForEach("/", func(m Meta, r io.Reader) error {
+		h := crc32.NewIEEE()
+		if _, err := io.Copy(h, r); err != nil || h.Sum32() != m.Crc32 {
+			bad = append(bad, m.Name)
+		}
+		return nil
+	})
+	return bad
+}
+
+func TestDurability(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	torn := func(n int) int { return rnd.Intn(n+2) - 1 }
+	drop := func(int) int { return -1 }
+	write := func(p *Package, n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := p.WriteAll(fmt.Sprintf("/d/%02d", i), random(4096*2+1000*i)); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	for _, d := range []Durability{DurabilityStrict, DurabilityBatched, DurabilityNone} {
+		path := filepath.Join(t.TempDir(), "testdur")
+		fs := newFaultStore(4096)
+		fs.delay = 5 * time.Millisecond
+		p, err := Open(path, OpenOptions{BlockSize: 4096, Store: fs, Durability: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(p, 16)
+		switch d {
+		case DurabilityStrict:
+			if fs.syncs != 16 {
+				t.Fatal(d, fs.syncs)
+			}
+		case DurabilityBatched:
+			if fs.syncs == 0 || fs.syncs >= 16 {
+				t.Fatal(d, fs.syncs)
+			}
+		case DurabilityNone:
+			if fs.syncs != 0 {
+				t.Fatal(d, fs.syncs)
+			}
+		}
+		// Writes in progress when crashing are not committed, tearing them is harmless
+		fs.pending = append(fs.pending, faultWrite{100, 0, random(4096)})
+		p.Close()
+
+		bad := corrupted(t, path, fs.crash(torn))
+		if d != DurabilityNone && len(bad) > 0 {
+			t.Fatal(d, bad)
+		}
+	}
+
+	// Without syncing, data of committed files may never reach the disk
+	path := filepath.Join(t.TempDir(), "testdur")
+	fs := newFaultStore(4096)
+	p, err := Open(path, OpenOptions{BlockSize: 4096, Store: fs, Durability: DurabilityNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(p, 4)
+	p.Close()
+	if bad := corrupted(t, path, fs.crash(drop)); len(bad) != 4 {
+		t.Fatal(bad)
+	}
+
+	// unless the package is synced
+	path = filepath.Join(t.TempDir(), "testdur")
+	fs = newFaultStore(4096)
+	if p, err = Open(path, OpenOptions{BlockSize: 4096, Store: fs, Durability: DurabilityNone}); err != nil {
+		t.Fatal(err)
+	}
+	write(p, 4)
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if bad := corrupted(t, path, fs.crash(drop)); len(bad) != 0 {
+		t.Fatal(bad)
+	}
+}
+
+var (
+	errInjected      = errors.New("injected fault")
+	errCrashed       = errors.New("crashed")
+	errNoIndexFaults = errors.New("index faults are not supported")
+)
+
+func isInjected(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), errInjected.Error()) || strings.Contains(err.Error(), errCrashed.Error()))
+}
+
+type faultMode int
+
+const (
+	faultFail faultMode = iota
+	faultShort
+	faultCrash
+	faultIndex
+)
+
+// faultFS opens data files whose writes, syncs and truncations, as well as
+// commits of operations seen by its hook, are counted. The at-th one fails,
+// writes part of its data or crashes according to mode, or makes bbolt fail
+// writing the index on the next commit, besides about one in failEvery fails
+// after a short write. Once crashed everything fails, and recover leaves the
+// files as a power failure at that time would have.
+type faultFS struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	ops, at     int
+	mode        faultMode
+	failEvery   int
+	faults      int
+	track       bool     // record writes not synced yet, so recover can undo them
+	index       *os.File // index opened by bbolt
+	repair      func()   // makes the index writable again
+	breakErr    error    // breaking the index failed
+	brokenHooks int      // commits seen since the index was broken
+	snapshot    []byte   // index at the time of the crash
+	files       []*faultFile
+}
+
+type faultFile struct {
+	*os.File
+	fs      *faultFS
+	pending []undo
+}
+
+// undo restores a write of n bytes at off.
+type undo struct {
+	off  int64
+	n    int
+	old  []byte
+	size int64
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (dataFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	ff := &faultFile{File: f, fs: fs}
+	fs.mu.Lock()
+	fs.files = append(fs.files, ff)
+	fs.mu.Unlock()
+	return ff, nil
+}
+
+func (fs *faultFS) OpenIndex(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err == nil {
+		fs.mu.Lock()
+		fs.index = f
+		fs.mu.Unlock()
+	}
+	return f, err
+}
+
+// fault counts an operation and returns the fault to inject, if any. It is
+// called with fs.mu held.
+func (fs *faultFS) fault() (faultMode, bool) {
+	if fs.snapshot != nil {
+		return faultCrash, true
+	}
+	fs.ops++
+	switch {
+	case fs.ops == fs.at && fs.mode == faultIndex:
+		// The hook counts the fault once the commit is reached
+		fs.repair, fs.breakErr = breakFile(fs.index)
+		return 0, false
+	case fs.ops == fs.at:
+		fs.faults++
+		if fs.mode == faultCrash {
+			fs.snapshot, _ = ioutil.ReadFile(fs.index.Name())
+		}
+		return fs.mode, true
+	case fs.failEvery > 0 && fs.rng.Intn(fs.failEvery) == 0:
+		fs.faults++
+		return faultShort, true
+	}
+	return 0, false
+}
+
+func faultErr(mode faultMode) error {
+	if mode == faultCrash {
+		return errCrashed
+	}
+	return errInjected
+}
+
+func (fs *faultFS) crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.snapshot != nil
+}
+
+func (fs *faultFS) faulted() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.faults
+}
+
+// hook makes commits of operations fault points. Once the index is broken
+// the next commit fails writing it, the one after repairs it.
+func (fs *faultFS) hook() Hook {
+	return HookFuncs{Tx: true, AfterFunc: func(op *Operation) error {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		mode, ok := fs.fault()
+		if fs.repair != nil {
+			if fs.brokenHooks++; fs.brokenHooks == 1 {
+				fs.faults++
+			} else {
+				fs.heal()
+			}
+		}
+		if ok {
+			return faultErr(mode)
+		}
+		return nil
+	}}
+}
+
+// heal repairs the index if broken, it must be called before closing it. It
+// is called with fs.mu held.
+func (fs *faultFS) heal() {
+	if fs.repair != nil {
+		fs.repair()
+		fs.repair = nil
+	}
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	mode, ok := f.fs.fault()
+	if ok && mode != faultShort {
+		return 0, faultErr(mode)
+	}
+	if ok {
+		p = p[:f.fs.rng.Intn(len(p)+1)]
+	}
+	if f.fs.track {
+		u := undo{off: off, n: len(p), old: make([]byte, len(p))}
+		n, _ := f.File.ReadAt(u.old, off)
+		u.old = u.old[:n]
+		if fi, err := f.File.Stat(); err == nil {
+			u.size = fi.Size()
+		}
+		f.pending = append(f.pending, u)
+	}
+	n, err := f.File.WriteAt(p, off)
+	if ok && err == nil {
+		err = errInjected
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if mode, ok := f.fs.fault(); ok {
+		return faultErr(mode)
+	}
+	f.pending = nil
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if mode, ok := f.fs.fault(); ok {
+		return faultErr(mode)
+	}
+	pending := f.pending[:0]
+	for _, u := range f.pending {
+		if u.off < size {
+			pending = append(pending, u)
+		}
+	}
+	f.pending = pending
+	return f.File.Truncate(size)
+}
+
+// recover simulates a power failure at the time of the crash, or now if
+// there was none, once the package is closed. keep returns how many bytes
+// of an unsynced write of n bytes reached the disk.
+func (fs *faultFS) recover(keep func(n int) int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, f := range fs.files {
+		w, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for i := len(f.pending) - 1; i >= 0; i-- {
+			u := f.pending[i]
+			k := keep(u.n)
+			if k < len(u.old) {
+				w.WriteAt(u.old[k:], u.off+int64(k))
+			}
+			if k == 0 && u.size < u.off+int64(u.n) {
+				w.Truncate(u.size)
+			}
+		}
+		f.pending = nil
+		w.Close()
+	}
+	fs.files = nil
+	if fs.snapshot != nil {
+		return ioutil.WriteFile(fs.index.Name(), fs.snapshot, 0777)
+	}
+	return nil
+}
+
+// modelFile is what a file of a package is expected to be.
+type modelFile struct {
+	data []byte
+	tags map[string]string
+}
+
+// checkModel checks p holds exactly the files of model, and that counters,
+// the free bitmap and slots of shared blocks match their data.
+func checkModel(p *Package, model map[string]modelFile) error {
+	var size int64
+	used, masks := map[uint32]bool{}, map[uint32]uint64{}
+	n := 0
+	if err := p.ForEachMeta("/", func(m Meta) error {
+		f, ok := model[m.Name]
+		if !ok {
+			return fmt.Errorf("unexpected file %q", m.Name)
+		}
+		n++
+		size += m.Size
+		buf, err := p.ReadAll(m.Name)
+		if err != nil || !bytes.Equal(buf, f.data) || crc32.ChecksumIEEE(buf) != m.Crc32 {
+			return fmt.Errorf("%q: data mismatch, %v", m.Name, err)
+		}
+		if fmt.Sprint(m.Tags) != fmt.Sprint(f.tags) {
+			return fmt.Errorf("%q: tags %v, expect %v", m.Name, m.Tags, f.tags)
+		}
+		if err := m.Positions.ForEach(func(v uint32) error {
+			if used[v] {
+				return fmt.Errorf("%q: block %d used twice", m.Name, v)
+			}
+			used[v] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		if e := m.Tail; e != nil {
+			if masks[e.Block]&e.mask(p.alloc.slotSize) != 0 || used[e.Block] {
+				return fmt.Errorf("%q: tail %v overlaps", m.Name, *e)
+			}
+			masks[e.Block] |= e.mask(p.alloc.slotSize)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if n != len(model) {
+		return fmt.Errorf("%d files, expect %d", n, len(model))
+	}
+	if s := p.Stat(); s.Files != int64(n) || s.Size != size {
+		return fmt.Errorf("counters %d files of %d bytes, expect %d of %d", s.Files, s.Size, n, size)
+	}
+	return p.db.View(func(tx *bbolt.Tx) error {
+		bm := loadBitmap(tx)
+		for v := int64(0); v < int64(len(bm))*8; v++ {
+			b := uint32(v)
+			if set := bm[v/8]>>(v%8)&1 == 1; set != (used[b] || masks[b] != 0) {
+				return fmt.Errorf("free bitmap: block %d is %v", b, set)
+			}
+		}
+		for b := range used {
+			if int(b/8) >= len(bm) {
+				return fmt.Errorf("free bitmap: block %d missing", b)
+			}
+		}
+		packed := tx.Bucket(packedBucket)
+		if n := packed.Stats().KeyN; n != len(masks) {
+			return fmt.Errorf("%d shared blocks, expect %d", n, len(masks))
+		}
+		for b, mask := range masks {
+			if int(b/8) >= len(bm) {
+				return fmt.Errorf("free bitmap: block %d missing", b)
+			}
+			if v := packed.Get(uint32ToBytes(b)); len(v) != 8 || bytesToInt64(v) != int64(mask) {
+				return fmt.Errorf("shared block %d: mask %x, expect %x", b, v, mask)
+			}
+		}
+		return nil
+	})
+}
+
+// crashRun drives random operations against a package and a model, with a
+// fault injected at a random operation, then checks the package matches the
+// model after a crash and reopening.
+func crashRun(seed int64) error {
+	rng := rand.New(rand.NewSource(seed))
+	dir, err := ioutil.TempDir("", "testcrash")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "crash")
+	fs := &faultFS{
+		rng:   rand.New(rand.NewSource(seed)),
+		at:    1 + rng.Intn(80),
+		mode:  faultMode(rng.Intn(4)),
+		track: true,
+	}
+	if fs.mode == faultIndex && !canBreakFiles {
+		return errNoIndexFaults
+	}
+	o := OpenOptions{BlockSize: 4096, SmallThreshold: 256, Durability: Durability(seed % 2), Hooks: []Hook{fs.hook()}, fs: fs}
+	p, err := Open(path, o)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{"/a", "/b", "/c", "/d", "/e"}
+	data := func() []byte {
+		n := rng.Intn(4) * 4096
+		if rng.Intn(3) > 0 {
+			n += rng.Intn(4096)
+		}
+		buf := make([]byte, n)
+		rng.Read(buf)
+		return buf
+	}
+	model := map[string]modelFile{}
+	for i := 0; i < 60 && !fs.crashed(); i++ {
+		key, dst := keys[rng.Intn(len(keys))], keys[rng.Intn(len(keys))]
+		f, exists := model[key]
+		faults := fs.faulted()
+		var err error
+		switch op := rng.Intn(5); op {
+		case 0:
+			buf := data()
+			if err = p.WriteAll(key, buf); err == nil {
+				model[key] = modelFile{data: buf}
+			}
+			exists = true // must succeed
+		case 1:
+			buf := data()
+			if err = p.Append(key, bytes.NewReader(buf)); err == nil {
+				f.data = append(append([]byte{}, f.data...), buf...)
+				model[key] = f
+			}
+			exists = false // may fail on unaligned files
+		case 2:
+			if err = p.Delete(key); err == nil {
+				delete(model, key)
+			}
+		case 3:
+			if key == dst {
+				continue
+			}
+			if err = p.Move(key, dst, true); err == nil {
+				delete(model, key)
+				model[dst] = f
+			}
+		case 4:
+			k, v := keys[rng.Intn(len(keys))][1:], strconv.Itoa(i)
+			if err = p.UpdateTags(key, func(tags map[string]string) error {
+				tags[k] = v
+				return nil
+			}); err == nil {
+				tags := map[string]string{k: v}
+				for k, v := range f.tags {
+					if _, ok := tags[k]; !ok {
+						tags[k] = v
+					}
+				}
+				f.tags = tags
+				model[key] = f
+			}
+		}
+		if err != nil && exists && fs.faulted() == faults {
+			return fmt.Errorf("op %d on %q: %v", i, key, err)
+		}
+	}
+	fs.mu.Lock()
+	fs.heal()
+	fs.mu.Unlock()
+	p.Close()
+	if fs.breakErr != nil {
+		return fs.breakErr
+	}
+
+	if err := fs.recover(func(n int) int {
+		switch rng.Intn(3) {
+		case 0:
+			return 0
+		case 1:
+			return n
+		}
+		return rng.Intn(n + 1)
+	}); err != nil {
+		return err
+	}
+	if p, err = Open(path); err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := checkModel(p, model); err != nil {
+		return fmt.Errorf("after crash at %d of %d (mode %d): %v", fs.at, fs.ops, fs.mode, err)
+	}
+	// The allocator must be consistent as well
+	buf := data()
+	if err := p.WriteAll("/z", buf); err != nil {
+		return err
+	}
+	model["/z"] = modelFile{data: buf}
+	return checkModel(p, model)
+}
+
+func TestCrash(t *testing.T) {
+	skipped := 0
+	for seed := int64(1); seed <= 100; seed++ {
+		if err := crashRun(seed); err == errNoIndexFaults {
+			skipped++
+		} else if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+	if skipped > 0 {
+		t.Skipf("%d seeds: %v on this platform", skipped, errNoIndexFaults)
+	}
+}
+
+func benchmarkMetas(b *testing.B, legacy bool, f func(p *Package) error) {
+	p, err := Open(filepath.Join(b.TempDir(), "bench"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Batch(func(batch *Batch) error {
+		for i := 0; i < 2000; i++ {
+			batch.WriteAll(fmt.Sprintf("/b/%04d", i), random(100+i), "i", strconv.Itoa(i), "content-type", "image/jpeg")
+		}
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+	if legacy {
+		p.db.Update(func(tx *bbolt.Tx) error {
+			bk := tx.Bucket(trunkBucket)
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("/b/%04d", i))
+				m, _ := unmarshalMeta(bk.Get(key), p.blockSize)
+				buf, _ := json.Marshal(m)
+				bk.Put(key, buf)
+			}
+			return nil
+		})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkList(b *testing.B) {
+	list := func(p *Package) error {
+		_, err := p.List("/b")
+		return err
+	}
+	b.Run("json", func(b *testing.B) { benchmarkMetas(b, true, list) })
+	b.Run("binary", func(b *testing.B) { benchmarkMetas(b, false, list) })
+}
+
+func BenchmarkForEachMeta(b *testing.B) {
+	each := func(p *Package) error {
+		return p.ForEachMeta("/b", func(Meta) error { return nil })
+	}
+	b.Run("json", func(b *testing.B) { benchmarkMetas(b, true, each) })
+	b.Run("binary", func(b *testing.B) { benchmarkMetas(b, false, each) })
+}
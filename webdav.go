@@ -0,0 +1,458 @@
+package vfs
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/net/webdav"
+)
+
+// davPropPrefix prefixes tags holding WebDAV dead properties, the rest of the
+// tag key is "<namespace> <local name>".
+const davPropPrefix = "dav:"
+
+// NewDAVHandler returns a WebDAV handler serving prefix of p with the lock
+// system of p.
+func NewDAVHandler(p *Package, prefix string) *webdav.Handler {
+	return &webdav.Handler{
+		FileSystem: &DAVFileSystem{Package: p, Prefix: prefix},
+		LockSystem: p.DAVLockSystem(prefix),
+	}
+}
+
+// DAVLockSystem returns a webdav.LockSystem for handlers serving prefix. Locks
+// are shared by all handlers of p, even those serving other prefixes, so no
+// two of them can overwrite the same file concurrently.
+func (p *Package) DAVLockSystem(prefix string) webdav.LockSystem {
+	p.davOnce.Do(func() { p.davLocks = webdav.NewMemLS() })
+	return &davLockSystem{ls: p.davLocks, prefix: path.Join("/", prefix)}
+}
+
+type davLockSystem struct {
+	ls     webdav.LockSystem
+	prefix string
+}
+
+func (l *davLockSystem) key(name string) string {
+	if name == "" {
+		return ""
+	}
+	return path.Join(l.prefix, name)
+}
+
+func (l *davLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	return l.ls.Confirm(now, l.key(name0), l.key(name1), conditions...)
+}
+
+func (l *davLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = l.key(details.Root)
+	return l.ls.Create(now, details)
+}
+
+func (l *davLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := l.ls.Refresh(now, token, duration)
+	if l.prefix != "/" {
+		details.Root = "/" + strings.TrimPrefix(strings.TrimPrefix(details.Root, l.prefix), "/")
+	}
+	return details, err
+}
+
+func (l *davLockSystem) Unlock(now time.Time, token string) error {
+	return l.ls.Unlock(now, token)
+}
+
+// DAVFileSystem implements webdav.FileSystem over prefix of a Package. Dead
+// properties are stored in tags of files. Files opened for writing are
+// committed on Close, and only if no one else has changed them meanwhile.
+type DAVFileSystem struct {
+	Package *Package
+	Prefix  string
+}
+
+func (fs *DAVFileSystem) key(name string) string {
+	return path.Join("/", fs.Prefix, name)
+}
+
+func (fs *DAVFileSystem) info(key string) (Meta, error) {
+	if key == path.Join("/", fs.Prefix) {
+		return Meta{Name: strings.TrimSuffix(key, "/") + "/", IsDir: true}, nil
+	}
+	m, err := fs.Package.Info(key)
+	if err == ErrNotFound {
+		err = os.ErrNotExist
+	}
+	return m, err
+}
+
+func (fs *DAVFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	key := fs.key(name)
+	if _, err := fs.info(key); err == nil {
+		return os.ErrExist
+	}
+	if parent, err := fs.info(path.Dir(key)); err != nil || !parent.IsDir {
+		return os.ErrNotExist
+	}
+	return fs.Package.Mkdir(key)
+}
+
+func (fs *DAVFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	key := fs.key(name)
+	m, err := fs.info(key)
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	exists := err == nil
+
+	switch {
+	case !exists && (flag&os.O_CREATE == 0 || flag&(os.O_WRONLY|os.O_RDWR) == 0):
+		return nil, os.ErrNotExist
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case exists && (flag&os.O_TRUNC == 0 || flag&(os.O_WRONLY|os.O_RDWR) == 0):
+		// Data can only be replaced as a whole, writes to files opened
+		// otherwise fail, but their properties can be patched
+		f := &davFile{fs: fs, m: m}
+		if !m.IsDir {
+			if f.File, err = fs.Package.openMeta(m); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	case exists && m.IsDir:
+		return nil, ErrIsDirectory
+	}
+	if parent, err := fs.info(path.Dir(key)); err != nil || !parent.IsDir {
+		return nil, os.ErrNotExist
+	}
+
+	pr, pw := io.Pipe()
+	w := &davWriter{
+		m:    Meta{Name: key, Tags: map[string]string{}},
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	for k, v := range m.Tags {
+		w.m.Tags[k] = v
+	}
+	kvs := tagsToKVs(w.m.Tags)
+	go func() {
+		// m.Generation is 0 if the file doesn't exist, which requires it to stay so
+		err := fs.Package.If(IfGenerationMatch(m.Generation)).WriteContext(ctx, key, pr, kvs...)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	w.tags = func() error {
+		return fs.Package.UpdateTags(key, func(tags map[string]string) error {
+			for k := range tags {
+				delete(tags, k)
+			}
+			for k, v := range w.m.Tags {
+				tags[k] = v
+			}
+			return nil
+		})
+	}
+	return w, nil
+}
+
+// treeKeys returns names of files and directory markers under dir, markers
+// are returned from the deepest.
+func (fs *DAVFileSystem) treeKeys(dir string) (files, markers []string, err error) {
+	prefix := []byte(strings.TrimSuffix(dir, "/") + "/")
+	err = fs.Package.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(trunkBucket).Cursor()
+		for k, _ := c.Seek(prefix); strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+			if k[len(k)-1] == '/' {
+				markers = append(markers, strings.TrimSuffix(string(k), "/"))
+			} else {
+				files = append(files, string(k))
+			}
+		}
+		return nil
+	})
+	sort.Sort(sort.Reverse(sort.StringSlice(markers)))
+	return
+}
+
+func (fs *DAVFileSystem) RemoveAll(ctx context.Context, name string) error {
+	key := fs.key(name)
+	if key == path.Join("/", fs.Prefix) {
+		return os.ErrInvalid
+	}
+	m, err := fs.info(key)
+	if err != nil {
+		return err
+	}
+	if !m.IsDir {
+		return fs.Package.Delete(key)
+	}
+	files, markers, err := fs.treeKeys(key)
+	if err != nil {
+		return err
+	}
+	return fs.Package.Batch(func(b *Batch) error {
+		for _, f := range files {
+			b.Delete(f)
+		}
+		for _, d := range markers {
+			b.Delete(d)
+		}
+		return nil
+	})
+}
+
+func (fs *DAVFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldKey, newKey := fs.key(oldName), fs.key(newName)
+	m, err := fs.info(oldKey)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.info(newKey); err == nil {
+		return os.ErrExist
+	}
+	if !m.IsDir {
+		return fs.Package.Move(oldKey, newKey, false)
+	}
+	files, markers, err := fs.treeKeys(oldKey)
+	if err != nil {
+		return err
+	}
+	return fs.Package.Batch(func(b *Batch) error {
+		for i := len(markers) - 1; i >= 0; i-- {
+			b.Mkdir(newKey + markers[i][len(oldKey):])
+		}
+		for _, f := range files {
+			b.Move(f, newKey+f[len(oldKey):], false)
+		}
+		for _, d := range markers {
+			b.Delete(d)
+		}
+		return nil
+	})
+}
+
+func (fs *DAVFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	m, err := fs.info(fs.key(name))
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{m}, nil
+}
+
+// davFileInfo implements os.FileInfo, webdav.ETager and webdav.ContentTyper.
+type davFileInfo struct {
+	m Meta
+}
+
+func (fi davFileInfo) Name() string {
+	if name := strings.TrimSuffix(fi.m.Name, "/"); name != "" {
+		return path.Base(name)
+	}
+	return "/"
+}
+
+func (fi davFileInfo) Size() int64        { return fi.m.Size }
+func (fi davFileInfo) ModTime() time.Time { return time.Unix(fi.m.ModTime, 0) }
+func (fi davFileInfo) IsDir() bool        { return fi.m.IsDir }
+func (fi davFileInfo) Sys() interface{}   { return fi.m }
+
+func (fi davFileInfo) Mode() os.FileMode {
+	if fi.m.IsDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.m.IsDir || fi.m.Generation == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.m.ETag() + `"`, nil
+}
+
+func (fi davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if ct := fi.m.Tags[ContentTypeTag]; ct != "" {
+		return ct, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+func davProps(tags map[string]string) map[xml.Name]webdav.Property {
+	props := map[xml.Name]webdav.Property{}
+	for k, v := range tags {
+		if !strings.HasPrefix(k, davPropPrefix) {
+			continue
+		}
+		n := xml.Name{Local: k[len(davPropPrefix):]}
+		if idx := strings.LastIndex(n.Local, " "); idx > -1 {
+			n.Space, n.Local = n.Local[:idx], n.Local[idx+1:]
+		}
+		props[n] = webdav.Property{XMLName: n, InnerXML: []byte(v)}
+	}
+	return props
+}
+
+// patchProps applies patches to tags and reports all properties as patched.
+func patchProps(tags map[string]string, patches []webdav.Proppatch) webdav.Propstat {
+	ps := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			ps.Props = append(ps.Props, webdav.Property{XMLName: prop.XMLName})
+			k := davPropPrefix + prop.XMLName.Space + " " + prop.XMLName.Local
+			if patch.Remove {
+				delete(tags, k)
+			} else {
+				tags[k] = string(prop.InnerXML)
+			}
+		}
+	}
+	return ps
+}
+
+// davFile is a file or directory opened for reading.
+type davFile struct {
+	*File // nil for directories
+	fs    *DAVFileSystem
+	m     Meta
+	dir   []os.FileInfo
+	read  bool // dir is loaded
+}
+
+func (f *davFile) Close() error {
+	if f.File == nil {
+		return nil
+	}
+	return f.File.Close()
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.File == nil {
+		return 0, ErrIsDirectory
+	}
+	return f.File.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.File == nil {
+		return 0, ErrIsDirectory
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return davFileInfo{f.m}, nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.m.IsDir {
+		return nil, os.ErrInvalid
+	}
+	if !f.read {
+		metas, err := f.fs.Package.List(f.m.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range metas {
+			f.dir = append(f.dir, davFileInfo{m})
+		}
+		f.read = true
+	}
+	if count <= 0 {
+		res := f.dir
+		f.dir = nil
+		return res, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.dir) {
+		count = len(f.dir)
+	}
+	res := f.dir[:count]
+	f.dir = f.dir[count:]
+	return res, nil
+}
+
+func (f *davFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return davProps(f.m.Tags), nil
+}
+
+func (f *davFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if f.m.IsDir {
+		ps := patchProps(map[string]string{}, patches)
+		ps.Status = http.StatusForbidden
+		return []webdav.Propstat{ps}, nil
+	}
+	var ps webdav.Propstat
+	err := f.fs.Package.UpdateTags(f.m.Name, func(tags map[string]string) error {
+		ps = patchProps(tags, patches)
+		return nil
+	})
+	return []webdav.Propstat{ps}, err
+}
+
+// davWriter streams data written to it into the package, properties patched
+// meanwhile are stored after the data commits.
+type davWriter struct {
+	m       Meta // Name, Size and Tags only
+	pw      *io.PipeWriter
+	done    chan error
+	tags    func() error
+	patched bool
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.m.Size += int64(n)
+	return n, err
+}
+
+func (w *davWriter) Close() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		return err
+	}
+	if w.patched {
+		return w.tags()
+	}
+	return nil
+}
+
+func (w *davWriter) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrPermission
+}
+
+func (w *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (w *davWriter) Stat() (os.FileInfo, error) {
+	m := w.m
+	m.ModTime = time.Now().Unix()
+	return davFileInfo{m}, nil
+}
+
+func (w *davWriter) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return davProps(w.m.Tags), nil
+}
+
+func (w *davWriter) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	w.patched = true
+	return []webdav.Propstat{patchProps(w.m.Tags, patches)}, nil
+}
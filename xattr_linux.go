@@ -0,0 +1,7 @@
+package vfs
+
+import "syscall"
+
+func setxattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package vfs
+
+import "fmt"
+
+func setxattr(path, name, value string) error {
+	return fmt.Errorf("xattr not supported")
+}